@@ -0,0 +1,344 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/filesystem"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// ErrConfigInvalid is returned by LoadConfig when the configuration file
+// cannot be parsed.
+var ErrConfigInvalid = errors.New("invalid configuration")
+
+type Config struct {
+	LockDir      string        `toml:"lock_dir"`
+	Timeout      time.Duration `toml:"timeout"`
+	LockFileName string        `toml:"lock_filename"`
+	HistoryLines int           `toml:"history_lines"`
+	// MaxRuntime bounds how long a job may run once the lock is held. Zero
+	// means no limit.
+	MaxRuntime Duration `toml:"max_runtime"`
+	// KillGrace is how long a job is given to exit after SIGTERM before it
+	// is sent SIGKILL.
+	KillGrace Duration `toml:"kill_grace"`
+	// ForwardSignals lists the signals that are forwarded to the job rather
+	// than terminating jobwrapper.
+	ForwardSignals []string `toml:"forward_signals"`
+	// KillProcessGroup runs the job in its own process group and tears the
+	// whole group down when the job exits. Disable it for jobs that
+	// intentionally leave daemons running.
+	KillProcessGroup bool `toml:"kill_process_group"`
+	// OrphanPolicy is "kill", "wait" or "ignore" and controls what happens to
+	// descendants that outlive the job. Only supported on Linux. When unset
+	// it is "kill" if KillProcessGroup is set and "ignore" otherwise, so that
+	// disabling KillProcessGroup alone lets a job leave daemons running.
+	OrphanPolicy string `toml:"orphan_policy"`
+	// MaxConcurrency is how many jobs may hold a group at once. Zero or one
+	// makes the lock exclusive.
+	MaxConcurrency int `toml:"max_concurrency"`
+	// MaxJobs is how many jobs may run at once on the host, across all
+	// groups. Zero means no limit.
+	MaxJobs int `toml:"max_jobs"`
+	// OnLocked is "wait", "skip" or "fail" and controls what happens when the
+	// group is already locked.
+	OnLocked string `toml:"on_locked"`
+	// Fair makes jobs waiting for a group acquire it in the order they
+	// arrived.
+	Fair bool `toml:"fair"`
+	// Priority orders the jobs waiting for a group, highest first. It is
+	// usually set per group and can be overridden with --priority.
+	Priority int `toml:"priority"`
+	// StaleAfter is how long a job may hold a group before waiters treat it
+	// as stale. Zero means never.
+	StaleAfter Duration `toml:"stale_after"`
+	// StaleAction is "log", "term" or "kill" and controls what a waiter does
+	// about a stale holder besides logging it. term and kill signal the
+	// holder's process group.
+	StaleAction string `toml:"stale_action"`
+	// Retry controls whether failed jobs are run again.
+	Retry RetryConfig `toml:"retry"`
+	// LockBackend selects how groups are locked: "file" locks files in
+	// lock_dir with flock, "nfs-lease" takes leases in lock_dir that are safe
+	// on shared storage such as NFS, "redis" takes leases in Redis and "etcd"
+	// takes mutexes in etcd. Other backends may be registered with
+	// lock.Register. Backends other than file read their settings from a
+	// table named after them with Section.
+	LockBackend string `toml:"lock_backend"`
+	// HistoryBackend selects where run history is recorded: "file" appends
+	// JSON lines to a log per command in lock_dir. Other backends may be
+	// registered with history.Register.
+	HistoryBackend string `toml:"history_backend"`
+
+	Groups map[string]GroupConfig `toml:"groups"`
+
+	// sections holds the tables of the configuration file, for backends
+	// that read their own settings with Section.
+	sections map[string]any
+}
+
+// GroupConfig holds per-group overrides of the global settings. Zero values
+// inherit the global setting.
+type GroupConfig struct {
+	MaxRuntime Duration `toml:"max_runtime"`
+	KillGrace  Duration `toml:"kill_grace"`
+	// KillProcessGroup is a pointer so that a group can disable it.
+	KillProcessGroup *bool    `toml:"kill_process_group"`
+	OrphanPolicy     string   `toml:"orphan_policy"`
+	OnLocked         string   `toml:"on_locked"`
+	MaxConcurrency   int      `toml:"max_concurrency"`
+	Fair             *bool    `toml:"fair"`
+	Priority         int      `toml:"priority"`
+	StaleAfter       Duration `toml:"stale_after"`
+	StaleAction      string   `toml:"stale_action"`
+	// LockKey is a template for the name the group is locked under, such as
+	// "sync-{arg1}". It only applies to the group itself.
+	LockKey string `toml:"lock_key"`
+	// Retry replaces the global retry settings as a whole when set.
+	Retry *RetryConfig `toml:"retry"`
+}
+
+// RetryConfig controls retrying of failed jobs.
+type RetryConfig struct {
+	// MaxAttempts is the total number of times the job is run. Zero or one
+	// disables retries.
+	MaxAttempts int `toml:"max_attempts"`
+	// InitialBackoff is the delay before the first retry. It doubles with
+	// each further retry, up to MaxBackoff.
+	InitialBackoff Duration `toml:"initial_backoff"`
+	MaxBackoff     Duration `toml:"max_backoff"`
+	// RetryableExitCodes lists the exit codes that are retried. When empty
+	// any non-zero exit code is retried.
+	RetryableExitCodes []int `toml:"retryable_exit_codes"`
+	// ReleaseLock releases the group lock while waiting to retry, rather
+	// than holding it across attempts.
+	ReleaseLock bool `toml:"release_lock"`
+}
+
+var DefaultConfig = Config{
+	Timeout:          30 * time.Minute,
+	LockFileName:     ".lockfile",
+	HistoryLines:     5,
+	KillGrace:        Duration(10 * time.Second),
+	ForwardSignals:   []string{"SIGINT", "SIGTERM", "SIGHUP", "SIGQUIT"},
+	KillProcessGroup: true,
+	OnLocked:         "wait",
+	StaleAction:      "log",
+	LockBackend:      "file",
+	HistoryBackend:   "file",
+}
+
+// ForGroup returns a copy of the configuration with the overrides for the
+// given group applied.
+func (c Config) ForGroup(group string) Config {
+	gc, ok := c.Groups[group]
+	if !ok {
+		return c
+	}
+	if gc.MaxRuntime != 0 {
+		c.MaxRuntime = gc.MaxRuntime
+	}
+	if gc.KillGrace != 0 {
+		c.KillGrace = gc.KillGrace
+	}
+	if gc.KillProcessGroup != nil {
+		c.KillProcessGroup = *gc.KillProcessGroup
+	}
+	if gc.OrphanPolicy != "" {
+		c.OrphanPolicy = gc.OrphanPolicy
+	}
+	if gc.OnLocked != "" {
+		c.OnLocked = gc.OnLocked
+	}
+	if gc.MaxConcurrency != 0 {
+		c.MaxConcurrency = gc.MaxConcurrency
+	}
+	if gc.Fair != nil {
+		c.Fair = *gc.Fair
+	}
+	if gc.Priority != 0 {
+		c.Priority = gc.Priority
+	}
+	if gc.StaleAfter != 0 {
+		c.StaleAfter = gc.StaleAfter
+	}
+	if gc.StaleAction != "" {
+		c.StaleAction = gc.StaleAction
+	}
+	if gc.Retry != nil {
+		c.Retry = *gc.Retry
+	}
+	return c
+}
+
+// ForGroups returns a copy of the configuration for a job in all of the given
+// groups. Only the settings of the job itself are merged, and where the groups
+// disagree the most restrictive one wins: the shortest max_runtime and
+// kill_grace, kill_process_group if any group enables it, the strictest
+// orphan_policy and on_locked, and the retry settings with the fewest
+// attempts. An unknown orphan_policy or on_locked always wins, so that it is
+// reported. The settings of the groups' locks, such as max_concurrency, are
+// left as they are globally, to be resolved per group with ForGroup.
+func (c Config) ForGroups(groups []string) Config {
+	merged := c
+	for i, group := range groups {
+		gc := c.ForGroup(group)
+		gc.OrphanPolicy = gc.orphanPolicy()
+		if i == 0 {
+			merged.MaxRuntime = gc.MaxRuntime
+			merged.KillGrace = gc.KillGrace
+			merged.KillProcessGroup = gc.KillProcessGroup
+			merged.OrphanPolicy = gc.OrphanPolicy
+			merged.OnLocked = gc.OnLocked
+			merged.Retry = gc.Retry
+			continue
+		}
+		if gc.MaxRuntime != 0 && (merged.MaxRuntime == 0 || gc.MaxRuntime < merged.MaxRuntime) {
+			merged.MaxRuntime = gc.MaxRuntime
+		}
+		merged.KillGrace = min(merged.KillGrace, gc.KillGrace)
+		merged.KillProcessGroup = merged.KillProcessGroup || gc.KillProcessGroup
+		merged.OrphanPolicy = strictest(orphanPolicies, merged.OrphanPolicy, gc.OrphanPolicy)
+		merged.OnLocked = strictest(onLockedActions, merged.OnLocked, gc.OnLocked)
+		if max(gc.Retry.MaxAttempts, 1) < max(merged.Retry.MaxAttempts, 1) {
+			merged.Retry = gc.Retry
+		}
+	}
+	if len(groups) == 0 {
+		merged.OrphanPolicy = merged.orphanPolicy()
+	}
+	return merged
+}
+
+// orphanPolicy returns the orphan_policy of the configuration. Unless set,
+// orphans are handled like the rest of the process group, so that
+// kill_process_group = false alone lets a job daemonize.
+func (c Config) orphanPolicy() string {
+	if c.OrphanPolicy != "" {
+		return c.OrphanPolicy
+	}
+	if c.KillProcessGroup {
+		return "kill"
+	}
+	return "ignore"
+}
+
+var (
+	// orphanPolicies lists the values of orphan_policy, least strict first.
+	orphanPolicies = []string{"ignore", "wait", "kill"}
+	// onLockedActions lists the values of on_locked, least strict first.
+	onLockedActions = []string{"wait", "skip", "fail"}
+)
+
+// strictest returns the stricter of two values of a setting, given its values
+// ordered from least to most strict. A value that is not in the list is the
+// strictest.
+func strictest(values []string, a, b string) string {
+	rank := func(value string) int {
+		if i := slices.Index(values, value); i >= 0 {
+			return i
+		}
+		return len(values)
+	}
+	if rank(b) > rank(a) {
+		return b
+	}
+	return a
+}
+
+// LoadConfig reads the configuration file from ~/.jobwrapper, falling back to
+// the defaults when it does not exist. An error is returned if the file exists
+// but cannot be parsed.
+func LoadConfig(fs filesystem.FileSystem) (Config, error) {
+	config := DefaultConfig
+	// Decoding may reuse the backing array of slices, so give the config its own copy
+	config.ForwardSignals = slices.Clone(DefaultConfig.ForwardSignals)
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		// Handle error if needed
+		return config, nil
+	}
+
+	path := fmt.Sprintf("%s/.jobwrapper/jobwrapper.conf", home)
+
+	file, err := fs.Open(path)
+	if err == nil {
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return config, fmt.Errorf("error reading %s: %w", path, err)
+		}
+		if err := toml.Unmarshal(data, &config); err != nil {
+			return config, fmt.Errorf("%w: error parsing %s: %w", ErrConfigInvalid, path, err)
+		}
+		if err := toml.Unmarshal(data, &config.sections); err != nil {
+			return config, fmt.Errorf("%w: error parsing %s: %w", ErrConfigInvalid, path, err)
+		}
+	}
+
+	// Default lock directory if not provided
+	if config.LockDir == "" {
+		config.LockDir = ".jobwrapper"
+	}
+	if !isAbsPath(config.LockDir) {
+		// If lock_dir is relative, prepend the home directory
+		config.LockDir = fmt.Sprintf("%s/%s", home, config.LockDir)
+	}
+	return config, nil
+}
+
+// Section decodes the table with the given name into v, so that backends
+// registered outside this package can keep their settings in a subsection of
+// their own. Fields of v that the table does not set are left as they are, so
+// v may be filled with defaults beforehand. A missing table is not an error.
+func (c Config) Section(name string, v any) error {
+	table, ok := c.sections[name]
+	if !ok {
+		return nil
+	}
+	if _, ok := table.(map[string]any); !ok {
+		return fmt.Errorf("%w: %s: expected a table", ErrConfigInvalid, name)
+	}
+	data, err := toml.Marshal(table)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrConfigInvalid, name, err)
+	}
+	if err := toml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrConfigInvalid, name, err)
+	}
+	return nil
+}
+
+// SetSection replaces the table with the given name with v, encoded as it
+// would be written in the configuration file, so that a backend can be
+// configured without a file.
+func (c *Config) SetSection(name string, v any) error {
+	data, err := toml.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrConfigInvalid, name, err)
+	}
+	var table map[string]any
+	if err := toml.Unmarshal(data, &table); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrConfigInvalid, name, err)
+	}
+	// The sections may be shared with copies of the configuration
+	c.sections = maps.Clone(c.sections)
+	if c.sections == nil {
+		c.sections = make(map[string]any)
+	}
+	c.sections[name] = table
+	return nil
+}
+
+// isAbsPath checks if a path is absolute.
+func isAbsPath(path string) bool {
+	return path[0] == '/'
+}
@@ -0,0 +1,22 @@
+package config
+
+import "time"
+
+// Duration is a time.Duration that can be written in the configuration file
+// as a Go duration string such as "90s" or "1h30m".
+type Duration time.Duration
+
+// UnmarshalText parses a duration string from the configuration file.
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalText formats the duration as a Go duration string.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
@@ -0,0 +1,38 @@
+package jobwrapper
+
+import (
+	"errors"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/history"
+	"github.com/jacobalberty/jobwrapper/internal/command"
+	"github.com/jacobalberty/jobwrapper/lock"
+)
+
+// The errors returned by Run are wrapped, so they are checked for with
+// errors.Is and errors.As.
+var (
+	// ErrJobSkipped is returned when a job is skipped because its group is
+	// locked.
+	ErrJobSkipped = errors.New("job skipped as its group is locked")
+	// ErrLockLost is returned when a job was terminated because the lock
+	// backend lost its locks while it ran.
+	ErrLockLost = errors.New("lock lost while the job was running")
+	// ErrLockTimeout is returned when a group could not be locked within
+	// the timeout.
+	ErrLockTimeout = lock.ErrLockTimeout
+	// ErrLockCanceled is returned when waiting for a group was canceled,
+	// such as by a signal.
+	ErrLockCanceled = lock.ErrLockCanceled
+	// ErrConfigInvalid is returned when the configuration is invalid.
+	ErrConfigInvalid = config.ErrConfigInvalid
+	// ErrHistoryWrite is returned when the history could not be written.
+	ErrHistoryWrite = history.ErrHistoryWrite
+	// ErrMaxRuntimeExceeded is returned when the job was terminated for
+	// running longer than max_runtime.
+	ErrMaxRuntimeExceeded = command.ErrMaxRuntimeExceeded
+)
+
+// JobExitError is returned when the job ran but did not exit successfully. It
+// carries the job's exit code and the signal that terminated it, if any.
+type JobExitError = command.JobExitError
@@ -0,0 +1,103 @@
+package jobwrapper
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/history"
+	"github.com/jacobalberty/jobwrapper/internal/command"
+	"github.com/jacobalberty/jobwrapper/lock"
+)
+
+// Exit statuses reserved for failures of jobwrapper itself. They follow
+// sysexits.h so they are unlikely to collide with a job's own exit codes.
+// When the job runs, its exit status is passed through unchanged, or is
+// 128+n if it was terminated by signal n.
+const (
+	exitUsage          = 64  // Invalid command line
+	exitSkipped        = 69  // The job was skipped as its group was locked
+	exitWrapperFailure = 70  // Any other failure of the wrapper
+	exitHistoryFailure = 74  // The history could not be written
+	exitLockTimeout    = 75  // The lock was not acquired within the timeout
+	exitConfigInvalid  = 78  // The configuration file could not be loaded
+	exitNotExecutable  = 126 // The job could not be executed
+	exitNotFound       = 127 // The job was not found
+)
+
+// exitError associates an error returned by run with the status
+// jobwrapper should exit with.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// withExitCode annotates err with the exit status jobwrapper should use.
+func withExitCode(code int, err error) error {
+	return &exitError{code: code, err: err}
+}
+
+// ExitCode returns the exit status for an error returned by run.
+func ExitCode(err error) int {
+	var (
+		ee     *exitError
+		jobErr *command.JobExitError
+	)
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &ee):
+		return ee.code
+	case errors.As(err, &jobErr):
+		return jobExitCode(jobErr)
+	case errors.Is(err, lock.ErrLockTimeout):
+		return exitLockTimeout
+	case errors.Is(err, config.ErrConfigInvalid):
+		return exitConfigInvalid
+	case errors.Is(err, history.ErrHistoryWrite):
+		return exitHistoryFailure
+	}
+	return exitWrapperFailure
+}
+
+// jobExitCode returns the exit status that reflects how the job ended.
+func jobExitCode(err *command.JobExitError) int {
+	if err.Signal != nil {
+		return signalExitCode(err.Signal)
+	}
+	if err.ExitCode > 0 {
+		return err.ExitCode
+	}
+	return exitWrapperFailure
+}
+
+// startFailureCode returns the exit status for a job that could not be
+// started.
+func startFailureCode(err error) int {
+	switch {
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, os.ErrNotExist):
+		return exitNotFound
+	case errors.Is(err, os.ErrPermission):
+		return exitNotExecutable
+	}
+	return exitWrapperFailure
+}
+
+// signalExitCode returns the conventional exit status of a process
+// terminated by sig.
+func signalExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return exitWrapperFailure
+}
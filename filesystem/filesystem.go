@@ -11,4 +11,10 @@ type FileSystem interface {
 	Open(name string) (io.ReadCloser, error)
 	OpenFile(name string, flag int, perm os.FileMode) (io.ReadWriteCloser, error)
 	Remove(name string) error
+	ReadDir(name string) ([]os.DirEntry, error)
+	// Link creates newname as a hard link to oldname. It fails if newname
+	// exists.
+	Link(oldname, newname string) error
+	// Rename moves oldname to newname, replacing newname if it exists.
+	Rename(oldname, newname string) error
 }
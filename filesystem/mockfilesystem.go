@@ -17,6 +17,9 @@ type MockFileSystem struct {
 	OpenFunc     func(name string) (io.ReadCloser, error)
 	OpenFileFunc func(name string, flag int, perm os.FileMode) (io.ReadWriteCloser, error)
 	RemoveFunc   func(name string) error
+	ReadDirFunc  func(name string) ([]os.DirEntry, error)
+	LinkFunc     func(oldname, newname string) error
+	RenameFunc   func(oldname, newname string) error
 }
 
 // NewMockFileSystem creates a new MockFileSystem with optional file content for mocking.
@@ -29,6 +32,9 @@ func NewMockFileSystem(files map[string]*string) *MockFileSystem {
 		OpenFunc:     nil,
 		OpenFileFunc: nil,
 		RemoveFunc:   nil,
+		ReadDirFunc:  nil,
+		LinkFunc:     nil,
+		RenameFunc:   nil,
 	}
 }
 
@@ -128,3 +134,62 @@ func (m *MockFileSystem) RemoveDefault(name string) error {
 	}
 	return errors.New("file not found")
 }
+
+// ReadDir mimics listing a directory. Returns error if custom ReadDirFunc is not provided.
+func (m *MockFileSystem) ReadDir(name string) ([]os.DirEntry, error) {
+	if m.ReadDirFunc != nil {
+		return m.ReadDirFunc(name)
+	}
+	// Call default method if no custom function is provided
+	return m.ReadDirDefault(name)
+}
+
+// ReadDirDefault provides the default behavior for ReadDir.
+func (m *MockFileSystem) ReadDirDefault(name string) ([]os.DirEntry, error) {
+	// Default behavior: directories are not tracked, so report none
+	return nil, errors.New("directory not found")
+}
+
+// Link mimics creating a hard link. Returns error if custom LinkFunc is not provided.
+func (m *MockFileSystem) Link(oldname, newname string) error {
+	if m.LinkFunc != nil {
+		return m.LinkFunc(oldname, newname)
+	}
+	// Call default method if no custom function is provided
+	return m.LinkDefault(oldname, newname)
+}
+
+// LinkDefault provides the default behavior for Link.
+func (m *MockFileSystem) LinkDefault(oldname, newname string) error {
+	// Default behavior: both names share the contents in the Files map
+	content, ok := m.Files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, ok := m.Files[newname]; ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	m.Files[newname] = content
+	return nil
+}
+
+// Rename mimics moving a file. Returns error if custom RenameFunc is not provided.
+func (m *MockFileSystem) Rename(oldname, newname string) error {
+	if m.RenameFunc != nil {
+		return m.RenameFunc(oldname, newname)
+	}
+	// Call default method if no custom function is provided
+	return m.RenameDefault(oldname, newname)
+}
+
+// RenameDefault provides the default behavior for Rename.
+func (m *MockFileSystem) RenameDefault(oldname, newname string) error {
+	// Default behavior: move the contents in the Files map
+	content, ok := m.Files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	delete(m.Files, oldname)
+	m.Files[newname] = content
+	return nil
+}
@@ -23,3 +23,15 @@ func (fs OSFileSystem) OpenFile(name string, flag int, perm os.FileMode) (io.Rea
 func (fs OSFileSystem) Remove(name string) error {
 	return os.Remove(name)
 }
+
+func (fs OSFileSystem) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (fs OSFileSystem) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (fs OSFileSystem) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
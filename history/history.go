@@ -0,0 +1,264 @@
+package history
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+)
+
+// ErrHistoryWrite is returned when the history file cannot be created or
+// written.
+var ErrHistoryWrite = errors.New("error writing history")
+
+// HistoryWriter records the outcome of each attempt of a run.
+type HistoryWriter interface {
+	// WriteHistory records an attempt once it is over.
+	WriteHistory(result Result) error
+}
+
+// Result is the record of an attempt of a run. The wrapper fills it in as the
+// attempt goes and passes it to WriteHistory once the attempt is over.
+type Result struct {
+	// RunID identifies the run, and is shared by all of its attempts.
+	RunID string
+	// Attempt counts the attempts of the run from 1.
+	Attempt int
+	// Status is the outcome of the attempt. When empty it is derived from
+	// Err.
+	Status Status
+	// Start is when the attempt started, before its locks were acquired.
+	Start time.Time
+	// ExecutionStart and ExecutionEnd are when the job ran. They are zero if
+	// it did not.
+	ExecutionStart time.Time
+	ExecutionEnd   time.Time
+	// ExitCode is how the job process exited, or nil if it did not run. An
+	// exit code of -1 means the process did not exit normally, and Signal is
+	// the signal that terminated it, if any.
+	ExitCode *int
+	Signal   os.Signal
+	// Killed is why the wrapper killed the job.
+	Killed string
+	// Orphans are the command lines of descendants that outlived the job and
+	// had to be reaped.
+	Orphans []string
+	// Groups are the groups whose locks the job holds.
+	Groups []string
+	// JobSlotWait is how long the job waited for a max_jobs slot once its
+	// group locks were held, or nil if it did not wait for one.
+	JobSlotWait *time.Duration
+	// StaleHolders describe the holders of the job's locks that were found
+	// stale while waiting for them, and what was done about them.
+	StaleHolders []string
+	// HeldBy describes who held a lock the job could not acquire.
+	HeldBy []string
+	// Stale describes what was done about a run of another process that was
+	// found stale, for a record with StatusStale.
+	Stale string
+	// Err is the error the attempt ended with, or nil if it succeeded.
+	Err error
+}
+
+// NextAttempt returns the record of a retry of the run, starting now.
+func (r Result) NextAttempt() Result {
+	return Result{
+		RunID:   r.RunID,
+		Attempt: r.Attempt + 1,
+		Start:   time.Now(),
+		Groups:  r.Groups,
+	}
+}
+
+type historyJsonFileWriter struct {
+	fs      filesystem.FileSystem
+	cfg     *config.Config
+	exePath string
+	args    []string
+}
+
+func (h *historyJsonFileWriter) WriteHistory(result Result) error {
+
+	history := h.createLogEntry(result)
+
+	if err := appendHistory(h.fs, filepath.Join(h.cfg.LockDir, filepath.Base(h.exePath)+".log"), history, h.cfg.HistoryLines); err != nil {
+		return fmt.Errorf("%w: %w", ErrHistoryWrite, err)
+	}
+
+	return nil
+}
+
+func NewHistoryWriter(fs filesystem.FileSystem, cfg *config.Config, exePath string, args []string) (HistoryWriter, error) {
+	exeName := filepath.Base(exePath)
+	logPath := filepath.Join(cfg.LockDir, exeName+".log")
+
+	// Ensure the log file exists
+	file, err := fs.OpenFile(logPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHistoryWrite, err)
+	}
+	file.Close()
+
+	return &historyJsonFileWriter{
+		fs:      fs,
+		cfg:     cfg,
+		exePath: exePath,
+		args:    args,
+	}, nil
+}
+
+// NewRunID returns a random identifier for a run.
+func NewRunID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (h *historyJsonFileWriter) createLogEntry(result Result) string {
+	var (
+		exeName   = filepath.Base(h.exePath)
+		logBuffer strings.Builder
+		logArgs   []any
+		endTime   = time.Now()
+		status    = result.Status
+	)
+	if status == "" {
+		status = StatusSuccess
+		if result.Err != nil {
+			status = StatusFailed
+		}
+	}
+	logArgs = append(logArgs,
+		"run_id", result.RunID,
+		"attempt", result.Attempt,
+		"status", status,
+		"start", result.Start.Format("2006-01-02 15:04:05"),
+		"end", endTime.Format("2006-01-02 15:04:05"),
+		"duration", endTime.Sub(result.Start).String(),
+	)
+	if len(result.Groups) > 0 {
+		logArgs = append(logArgs,
+			"groups", result.Groups,
+		)
+	}
+
+	if !result.ExecutionStart.IsZero() {
+		logArgs = append(logArgs,
+			"wait_duration", result.ExecutionStart.Sub(result.Start).String(),
+			"start_execution", result.ExecutionStart.Format("2006-01-02 15:04:05"),
+		)
+	}
+	if result.JobSlotWait != nil {
+		logArgs = append(logArgs,
+			"job_slot_wait_duration", result.JobSlotWait.String(),
+		)
+	}
+	if !result.ExecutionStart.IsZero() && !result.ExecutionEnd.IsZero() {
+		logArgs = append(logArgs,
+			"end_execution", result.ExecutionEnd.Format("2006-01-02 15:04:05"),
+			"execution_duration", result.ExecutionEnd.Sub(result.ExecutionStart).String(),
+		)
+	}
+
+	if result.ExitCode != nil {
+		logArgs = append(logArgs,
+			"exit_code", *result.ExitCode,
+		)
+	}
+	if result.Signal != nil {
+		logArgs = append(logArgs,
+			"signal", result.Signal.String(),
+		)
+	}
+	if len(result.Orphans) > 0 {
+		logArgs = append(logArgs,
+			"orphans_reaped", len(result.Orphans),
+			"orphans", result.Orphans,
+		)
+	}
+	if result.Killed != "" {
+		logArgs = append(logArgs,
+			"killed", result.Killed,
+		)
+	}
+	if len(result.StaleHolders) > 0 {
+		logArgs = append(logArgs,
+			"stale_holders", result.StaleHolders,
+		)
+	}
+	if len(result.HeldBy) > 0 {
+		logArgs = append(logArgs,
+			"held_by", result.HeldBy,
+		)
+	}
+	if result.Stale != "" {
+		logArgs = append(logArgs,
+			"stale", result.Stale,
+		)
+	}
+
+	logArgs = append(logArgs,
+		"executable", exeName,
+		"args", h.args,
+		"executable_path", h.exePath,
+		"error", result.Err,
+	)
+
+	logger := slog.New(slog.NewJSONHandler(&logBuffer, nil))
+	logger.Info("script execution",
+		logArgs...,
+	)
+	return logBuffer.String()
+}
+
+func appendHistory(fs filesystem.FileSystem, logPath, history string, maxLines int) error {
+	file, err := fs.OpenFile(logPath, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text()+"\n")
+		if len(lines) > maxLines {
+			lines = lines[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	lines = append(lines, history)
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	file, err = fs.OpenFile(logPath, os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for _, line := range lines {
+		_, err := writer.WriteString(line)
+		if err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package history
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+)
+
+func TestWriteHistory(t *testing.T) {
+	mockFS := &filesystem.MockFileSystem{Files: make(map[string]*string)}
+	filePath := "test_history"
+	maxLines := 5
+
+	cfg := &config.Config{
+		LockDir: "/tmp",
+	}
+
+	historyWriter, err := NewHistoryWriter(mockFS, cfg, filePath, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	start := time.Now()
+
+	time.Sleep(1 * time.Second) // Simulate some duration
+
+	err = historyWriter.WriteHistory(Result{RunID: NewRunID(), Attempt: 1, Start: start, ExecutionEnd: time.Now()})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	file, err := mockFS.OpenFile(filepath.Join(cfg.LockDir, filePath+".log"), os.O_RDONLY, 0644)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	lines := bytes.Split(content, []byte("\n"))
+	if len(lines) > maxLines+1 { // +1 because of the trailing newline
+		t.Fatalf("expected lines to be <= %d, got %d", maxLines+1, len(lines))
+	}
+
+	expectedPrefix := time.Now().Format("2006-01-02")
+	if !bytes.Contains(content, []byte(expectedPrefix)) {
+		t.Fatalf("expected content to contain prefix %s, got %s", expectedPrefix, string(content))
+	}
+}
+
+func TestWriteHistory_FailedRun(t *testing.T) {
+	mockFS := &filesystem.MockFileSystem{Files: make(map[string]*string)}
+	cfg := &config.Config{
+		LockDir:      "/tmp",
+		HistoryLines: 5,
+	}
+
+	historyWriter, err := NewHistoryWriter(mockFS, cfg, "failing_job", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	exitCode := 3
+	result := Result{
+		RunID:          NewRunID(),
+		Attempt:        1,
+		Start:          time.Now(),
+		ExecutionStart: time.Now(),
+		ExecutionEnd:   time.Now(),
+		ExitCode:       &exitCode,
+		Err:            errors.New("exit status 3"),
+	}
+	if err := historyWriter.WriteHistory(result); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	content := *mockFS.Files[filepath.Join(cfg.LockDir, "failing_job.log")]
+	for _, expected := range []string{
+		`"status":"failed"`,
+		`"exit_code":3`,
+		`"end_execution":`,
+		`"execution_duration":`,
+		`"error":"exit status 3"`,
+	} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("expected content to contain %s, got %s", expected, content)
+		}
+	}
+}
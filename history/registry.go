@@ -0,0 +1,81 @@
+package history
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+)
+
+// Factory creates a HistoryWriter recording a run of the command at exePath.
+type Factory func(fs filesystem.FileSystem, cfg *config.Config, exePath string, args []string) (HistoryWriter, error)
+
+// DefaultBackend is the history backend used when history_backend is not set.
+const DefaultBackend = "file"
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]Factory{
+		"file": NewHistoryWriter,
+	}
+)
+
+// Register makes a history backend available under name, so that it can be
+// selected with history_backend. A backend with settings of its own reads
+// them from its config.Config.Section. Register panics if name is already
+// taken, as it is meant to be called from init functions.
+func Register(name string, factory Factory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if _, ok := backends[name]; ok {
+		panic(fmt.Sprintf("history backend %q registered twice", name))
+	}
+	backends[name] = factory
+}
+
+// Backends returns the names of the registered history backends, sorted.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	return slices.Sorted(maps.Keys(backends))
+}
+
+// NewWriter creates the history writer of the backend selected by
+// history_backend.
+func NewWriter(fs filesystem.FileSystem, cfg *config.Config, exePath string, args []string) (HistoryWriter, error) {
+	name := cfg.HistoryBackend
+	if name == "" {
+		name = DefaultBackend
+	}
+	backendsMu.RLock()
+	factory, ok := backends[name]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: history_backend: unknown backend %q, expected one of %s",
+			config.ErrConfigInvalid, name, strings.Join(Backends(), ", "))
+	}
+	return factory(fs, cfg, exePath, args)
+}
+
+// WriteStaleRun appends an entry with status stale to the history of another
+// run, which was found holding its lock for longer than stale_after. The entry
+// covers the run up to the time it was found, and reason describes what was
+// done about it.
+func WriteStaleRun(fs filesystem.FileSystem, cfg *config.Config, exePath string, args []string, runID string, started time.Time, reason string) error {
+	writer, err := NewWriter(fs, cfg, exePath, args)
+	if err != nil {
+		return err
+	}
+	return writer.WriteHistory(Result{
+		RunID:   runID,
+		Attempt: 1,
+		Status:  StatusStale,
+		Start:   started,
+		Stale:   reason,
+	})
+}
@@ -0,0 +1,53 @@
+package history
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+)
+
+// discardWriter is a history backend that records nothing
+type discardWriter struct{}
+
+func (discardWriter) WriteHistory(result Result) error {
+	return nil
+}
+
+func TestNewWriter(t *testing.T) {
+	Register("registry-test", func(fs filesystem.FileSystem, cfg *config.Config, exePath string, args []string) (HistoryWriter, error) {
+		return discardWriter{}, nil
+	})
+
+	mockFS := &filesystem.MockFileSystem{Files: make(map[string]*string)}
+	cfg := &config.Config{LockDir: "/tmp", HistoryLines: 5, HistoryBackend: "registry-test"}
+	writer, err := NewWriter(mockFS, cfg, "job", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, ok := writer.(discardWriter); !ok {
+		t.Errorf("expected the registered backend, got %T", writer)
+	}
+	// Stale runs are recorded by the selected backend
+	if err := WriteStaleRun(mockFS, cfg, "job", nil, "run1", time.Now(), "logged"); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	cfg.HistoryBackend = ""
+	if err := WriteStaleRun(mockFS, cfg, "job", nil, "run1", time.Now(), "logged"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	content := *mockFS.Files[filepath.Join(cfg.LockDir, "job.log")]
+	if !strings.Contains(content, `"status":"stale"`) || !strings.Contains(content, `"run_id":"run1"`) {
+		t.Errorf("expected the stale run to be recorded, got %s", content)
+	}
+
+	cfg.HistoryBackend = "bogus"
+	if _, err := NewWriter(mockFS, cfg, "job", nil); !errors.Is(err, config.ErrConfigInvalid) {
+		t.Errorf("expected an invalid config error, got %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+package history
+
+// Status is the outcome of a run as recorded in the history.
+type Status string
+
+const (
+	// StatusSuccess means the job ran and exited with code 0.
+	StatusSuccess Status = "success"
+	// StatusFailed means the job, or the wrapper around it, failed.
+	StatusFailed Status = "failed"
+	// StatusKilled means the wrapper killed the job.
+	StatusKilled Status = "killed"
+	// StatusLockTimeout means the lock could not be acquired in time.
+	StatusLockTimeout Status = "lock_timeout"
+	// StatusSkipped means the job was not run because its group was busy.
+	StatusSkipped Status = "skipped"
+	// StatusStale means another run found the job holding its lock for
+	// longer than stale_after. It is written by that other run.
+	StatusStale Status = "stale"
+)
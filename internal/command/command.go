@@ -2,14 +2,68 @@ package command
 
 import (
 	"context"
+	"errors"
 	"io"
+	"os"
+	"time"
 )
 
+// ErrMaxRuntimeExceeded is returned by Run when the command was terminated
+// for running longer than its maximum runtime.
+var ErrMaxRuntimeExceeded = errors.New("maximum runtime exceeded")
+
+// JobExitError is returned by Run when the job ran but did not exit
+// successfully.
+type JobExitError struct {
+	// ExitCode is the exit code of the job, or -1 if it was terminated by
+	// a signal.
+	ExitCode int
+	// Signal is the signal that terminated the job, if any.
+	Signal os.Signal
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *JobExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *JobExitError) Unwrap() error {
+	return e.Err
+}
+
 // Command defines an interface for wrapping command execution
 type Command interface {
 	Run() error
 	SetStdout(io.Writer)
 	SetStderr(io.Writer)
+	// SetMaxRuntime limits how long the command may run. Zero disables the limit.
+	SetMaxRuntime(time.Duration)
+	// SetKillGrace sets how long the command is given to exit after being
+	// asked to terminate before it is killed.
+	SetKillGrace(time.Duration)
+	// SetSignals sets a channel of signals to forward to the command while
+	// it runs.
+	SetSignals(<-chan os.Signal)
+	// SetKillProcessGroup sets whether the command runs in its own process
+	// group, which is signaled as a whole and torn down when the command
+	// exits.
+	SetKillProcessGroup(bool)
+	// SetOrphanPolicy sets how descendants that outlive the command are
+	// handled before Run returns.
+	SetOrphanPolicy(OrphanPolicy)
+	// SetStartHook sets a function that Run calls once the command has
+	// started, with the process group it leads, or zero if it does not run
+	// in a process group of its own.
+	SetStartHook(func(pgid int))
+	// Orphans returns the command lines of descendants that outlived the
+	// command and were handled by Run.
+	Orphans() []string
+	// ExitCode returns the exit code of the exited command, or -1 if it has
+	// not exited or was terminated by a signal.
+	ExitCode() int
+	// Signal returns the signal that terminated the command, if any.
+	Signal() os.Signal
 }
 
 // CommandContextFunc abstracts the creation of commands
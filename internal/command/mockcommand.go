@@ -1,8 +1,11 @@
 package command
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"time"
 )
 
 // MockCommand provides a mock implementation of the Command interface
@@ -10,13 +13,26 @@ type MockCommand struct {
 	RunFunc       func() error
 	SetStdoutFunc func(io.Writer)
 	SetStderrFunc func(io.Writer)
-	StdoutContent string // Mock stdout output
-	StderrContent string // Mock stderr output
+	StdoutContent string           // Mock stdout output
+	StderrContent string           // Mock stderr output
+	MaxRuntime    time.Duration    // Last value passed to SetMaxRuntime
+	KillGrace     time.Duration    // Last value passed to SetKillGrace
+	ExitStatus    int              // Value returned by ExitCode
+	ExitSignal    os.Signal        // Value returned by Signal
+	Signals       <-chan os.Signal // Last value passed to SetSignals
+	ProcessGroup  bool             // Last value passed to SetKillProcessGroup
+	OrphanPolicy  OrphanPolicy     // Last value passed to SetOrphanPolicy
+	OrphanLines   []string         // Value returned by Orphans
+	PGID          int              // Passed by Run to the start hook
+	startHook     func(pgid int)
 	stdout        io.Writer
 	stderr        io.Writer
 }
 
 func (mc *MockCommand) Run() error {
+	if mc.startHook != nil {
+		mc.startHook(mc.PGID)
+	}
 	// Write mock content to stdout and stderr
 	if mc.stdout != nil && mc.StdoutContent != "" {
 		fmt.Fprint(mc.stdout, mc.StdoutContent)
@@ -24,10 +40,16 @@ func (mc *MockCommand) Run() error {
 	if mc.stderr != nil && mc.StderrContent != "" {
 		fmt.Fprint(mc.stderr, mc.StderrContent)
 	}
-	if mc.RunFunc != nil {
-		return mc.RunFunc()
+	if mc.RunFunc == nil {
+		return nil
+	}
+	err := mc.RunFunc()
+	// Report a non-zero exit status or signal the way RealCommand would
+	var jobErr *JobExitError
+	if err != nil && (mc.ExitStatus != 0 || mc.ExitSignal != nil) && !errors.As(err, &jobErr) {
+		err = &JobExitError{ExitCode: mc.ExitStatus, Signal: mc.ExitSignal, Err: err}
 	}
-	return nil
+	return err
 }
 
 func (mc *MockCommand) SetStdout(w io.Writer) {
@@ -43,3 +65,39 @@ func (mc *MockCommand) SetStderr(w io.Writer) {
 		mc.SetStderrFunc(w)
 	}
 }
+
+func (mc *MockCommand) SetMaxRuntime(d time.Duration) {
+	mc.MaxRuntime = d
+}
+
+func (mc *MockCommand) SetKillGrace(d time.Duration) {
+	mc.KillGrace = d
+}
+
+func (mc *MockCommand) ExitCode() int {
+	return mc.ExitStatus
+}
+
+func (mc *MockCommand) Signal() os.Signal {
+	return mc.ExitSignal
+}
+
+func (mc *MockCommand) SetSignals(signals <-chan os.Signal) {
+	mc.Signals = signals
+}
+
+func (mc *MockCommand) SetKillProcessGroup(enabled bool) {
+	mc.ProcessGroup = enabled
+}
+
+func (mc *MockCommand) SetOrphanPolicy(policy OrphanPolicy) {
+	mc.OrphanPolicy = policy
+}
+
+func (mc *MockCommand) SetStartHook(hook func(pgid int)) {
+	mc.startHook = hook
+}
+
+func (mc *MockCommand) Orphans() []string {
+	return mc.OrphanLines
+}
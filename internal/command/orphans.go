@@ -0,0 +1,163 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// OrphanPolicy controls what happens to descendants of a job that outlive it.
+type OrphanPolicy string
+
+const (
+	// OrphanKill terminates orphaned descendants, escalating to a kill after
+	// the kill grace period.
+	OrphanKill OrphanPolicy = "kill"
+	// OrphanWait waits for orphaned descendants to exit on their own.
+	OrphanWait OrphanPolicy = "wait"
+	// OrphanIgnore leaves orphaned descendants running.
+	OrphanIgnore OrphanPolicy = "ignore"
+)
+
+// ParseOrphanPolicy validates an orphan policy from the configuration file.
+func ParseOrphanPolicy(s string) (OrphanPolicy, error) {
+	switch policy := OrphanPolicy(s); policy {
+	case OrphanKill, OrphanWait, OrphanIgnore:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown orphan policy %q", s)
+}
+
+// processInfo is what is known of a running process.
+type processInfo struct {
+	ppid int
+	// start is when the process started, which tells it from a later process
+	// reusing its PID.
+	start uint64
+}
+
+// descendants records the processes descended from the job, keyed by PID, so
+// that other children of this process are never handled as its orphans.
+type descendants map[int]processInfo
+
+// alive reports whether the recorded process with the given PID is still
+// running, rather than another process reusing its PID.
+func (d descendants) alive(pid int, table map[int]processInfo) bool {
+	recorded, ok := d[pid]
+	if !ok {
+		return false
+	}
+	info, ok := table[pid]
+	return ok && info.start == recorded.start
+}
+
+// update records the processes in table that are children of a recorded
+// descendant. A descendant whose parent exited before it was recorded is
+// reparented to this process, and is recognized by the marker the job's
+// environment was given.
+func (d descendants) update(table map[int]processInfo, marker string) {
+	self := os.Getpid()
+	for changed := true; changed; {
+		changed = false
+		for pid, info := range table {
+			if d.alive(pid, table) {
+				continue
+			}
+			if d.alive(info.ppid, table) || (info.ppid == self && hasEnv(pid, marker)) {
+				d[pid] = info
+				changed = true
+			}
+		}
+	}
+}
+
+// trackDescendants records the descendants of the command every
+// groupPollInterval until the returned function is called.
+func (rc *RealCommand) trackDescendants() (stop func()) {
+	rc.descendants = make(descendants)
+	table := processTable()
+	if info, ok := table[rc.cmd.Process.Pid]; ok {
+		rc.descendants[rc.cmd.Process.Pid] = info
+	}
+	rc.descendants.update(table, rc.marker)
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(groupPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+			}
+			rc.descendants.update(processTable(), rc.marker)
+		}
+	}()
+	return func() {
+		close(stopCh)
+		<-done
+	}
+}
+
+// reapOrphans handles descendants of the command that were reparented to
+// this process after their parents exited, according to the orphan policy.
+// It returns once none remain, recording the command line of each orphan.
+// Only the command's descendants are waited for or signaled, so other
+// children of this process are left alone.
+func (rc *RealCommand) reapOrphans() {
+	if rc.orphanPolicy == OrphanIgnore || !rc.subreaper {
+		return
+	}
+
+	var (
+		self       = os.Getpid()
+		seen       = make(map[int]bool)
+		terminated = make(map[int]bool)
+		policy     = rc.orphanPolicy
+		deadline   time.Time
+	)
+	for {
+		table := processTable()
+		rc.descendants.update(table, rc.marker)
+		var orphans []int
+		for pid, info := range table {
+			if pid == rc.cmd.Process.Pid || info.ppid != self || !rc.descendants.alive(pid, table) {
+				continue
+			}
+			if !reapChild(pid) {
+				orphans = append(orphans, pid)
+			}
+		}
+		if len(orphans) == 0 {
+			return
+		}
+
+		if policy == OrphanWait && rc.ctx.Err() != nil {
+			// Stop waiting once the run is canceled
+			policy = OrphanKill
+		}
+
+		for _, pid := range orphans {
+			if !seen[pid] {
+				seen[pid] = true
+				rc.orphans = append(rc.orphans, commandLine(pid))
+			}
+			if policy == OrphanKill && !terminated[pid] {
+				terminated[pid] = true
+				deadline = time.Now().Add(rc.killGrace)
+				_ = signalPid(pid, syscall.SIGTERM)
+			}
+		}
+		if policy == OrphanKill && time.Now().After(deadline) {
+			for _, pid := range orphans {
+				_ = signalPid(pid, syscall.SIGKILL)
+			}
+		}
+
+		time.Sleep(groupPollInterval)
+	}
+}
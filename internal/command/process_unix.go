@@ -0,0 +1,60 @@
+//go:build !windows
+
+package command
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in a new process group led by the command.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalProcess sends sig to p, or to every process in the process group led
+// by p if group is set.
+func signalProcess(p *os.Process, group bool, sig os.Signal) error {
+	if !group {
+		return p.Signal(sig)
+	}
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return p.Signal(sig)
+	}
+	return syscall.Kill(-p.Pid, s)
+}
+
+// processGroupID returns the ID of the process group led by p.
+func processGroupID(p *os.Process) int {
+	return p.Pid
+}
+
+// processGroupExists reports whether any process remains in the process
+// group led by p.
+func processGroupExists(p *os.Process) bool {
+	err := syscall.Kill(-p.Pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// terminate politely asks the process, or its process group, to exit.
+func terminate(p *os.Process, group bool) error {
+	return signalProcess(p, group, syscall.SIGTERM)
+}
+
+// StopProcessGroup asks every process in the process group pgid to exit, or
+// kills them if force is set. The group is also continued, so that processes
+// that were stopped handle SIGTERM rather than staying stopped.
+func StopProcessGroup(pgid int, force bool) error {
+	if force {
+		return syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+	if err := syscall.Kill(-pgid, syscall.SIGTERM); err != nil {
+		return err
+	}
+	return syscall.Kill(-pgid, syscall.SIGCONT)
+}
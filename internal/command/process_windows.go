@@ -0,0 +1,42 @@
+//go:build windows
+
+package command
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op on Windows, where the job's descendants are not
+// tracked.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcess sends sig to p. Process groups are not supported on Windows
+// so group is ignored.
+func signalProcess(p *os.Process, group bool, sig os.Signal) error {
+	return p.Signal(sig)
+}
+
+// processGroupID returns zero as process groups are not supported on
+// Windows.
+func processGroupID(p *os.Process) int {
+	return 0
+}
+
+// processGroupExists always reports false as process groups are not
+// supported on Windows.
+func processGroupExists(p *os.Process) bool {
+	return false
+}
+
+// terminate asks the process to exit. Windows has no SIGTERM, so the
+// process is killed outright.
+func terminate(p *os.Process, group bool) error {
+	return p.Kill()
+}
+
+// StopProcessGroup is not supported on Windows, which has no process groups.
+func StopProcessGroup(pgid int, force bool) error {
+	return errors.New("process groups are not supported on Windows")
+}
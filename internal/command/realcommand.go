@@ -2,17 +2,167 @@ package command
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// groupPollInterval is how often killProcessGroup checks whether the
+// process group has exited.
+const groupPollInterval = 50 * time.Millisecond
+
 // RealCommand wraps exec.Cmd for actual command execution
 type RealCommand struct {
-	cmd *exec.Cmd
+	ctx        context.Context
+	cmd        *exec.Cmd
+	maxRuntime time.Duration
+	killGrace  time.Duration
+	signals    <-chan os.Signal
+	// processGroup runs the command in its own process group so that its
+	// descendants can be signaled and torn down with it.
+	processGroup bool
+	orphanPolicy OrphanPolicy
+	startHook    func(pgid int)
+	subreaper    bool
+	// marker is added to the command's environment, so that descendants
+	// orphaned before they were recorded can be told from other children
+	// of this process.
+	marker      string
+	descendants descendants
+	orphans     []string
 }
 
+// markerSeq tells apart the markers of commands run by this process
+var markerSeq atomic.Int64
+
+// Run starts the command and waits for it to exit, forwarding any signals
+// received on the signals channel. If the context is canceled or the maximum
+// runtime elapses the command is asked to terminate and, if it is still
+// running after the kill grace period, killed.
 func (rc *RealCommand) Run() error {
-	return rc.cmd.Run()
+	if rc.processGroup {
+		setProcessGroup(rc.cmd)
+	}
+	if rc.orphanPolicy != OrphanIgnore && enableSubreaper() {
+		rc.subreaper = true
+		defer disableSubreaper()
+		rc.marker = fmt.Sprintf("JOBWRAPPER_JOB=%d-%d", os.Getpid(), markerSeq.Add(1))
+		env := rc.cmd.Env
+		if env == nil {
+			env = os.Environ()
+		}
+		rc.cmd.Env = append(slices.Clip(env), rc.marker)
+	}
+	if err := rc.cmd.Start(); err != nil {
+		return err
+	}
+	if rc.startHook != nil {
+		pgid := 0
+		if rc.processGroup {
+			pgid = processGroupID(rc.cmd.Process)
+		}
+		rc.startHook(pgid)
+	}
+	// Orphans are handled first as killing them also takes care of any
+	// descendants that left the process group
+	defer rc.killProcessGroup()
+	defer rc.reapOrphans()
+	if rc.subreaper {
+		defer rc.trackDescendants()()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- rc.cmd.Wait()
+	}()
+
+	var deadline <-chan time.Time
+	if rc.maxRuntime > 0 {
+		timer := time.NewTimer(rc.maxRuntime)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		select {
+		case err := <-done:
+			return rc.exitError(err)
+		case sig := <-rc.signals:
+			// The process may already have exited, which the next
+			// iteration will observe.
+			_ = signalProcess(rc.cmd.Process, rc.processGroup, sig)
+		case <-rc.ctx.Done():
+			err := rc.stop(done)
+			if err == nil {
+				err = rc.ctx.Err()
+			}
+			return rc.exitError(err)
+		case <-deadline:
+			err := fmt.Errorf("%w (%s)", ErrMaxRuntimeExceeded, rc.maxRuntime)
+			if waitErr := rc.stop(done); waitErr != nil {
+				err = fmt.Errorf("%w: %w", err, waitErr)
+			}
+			return rc.exitError(err)
+		}
+	}
+}
+
+// exitError wraps err in a JobExitError describing how the process exited.
+func (rc *RealCommand) exitError(err error) error {
+	if err == nil || rc.cmd.ProcessState == nil {
+		return err
+	}
+	return &JobExitError{ExitCode: rc.ExitCode(), Signal: rc.Signal(), Err: err}
+}
+
+// stop asks the process to terminate, escalating to a kill once the grace
+// period has elapsed, and returns the result of waiting on it.
+func (rc *RealCommand) stop(done <-chan error) error {
+	if err := terminate(rc.cmd.Process, rc.processGroup); err != nil {
+		rc.kill()
+		return <-done
+	}
+
+	grace := time.NewTimer(rc.killGrace)
+	defer grace.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-grace.C:
+		rc.kill()
+		return <-done
+	}
+}
+
+// kill kills the process, or its process group.
+func (rc *RealCommand) kill() {
+	if err := signalProcess(rc.cmd.Process, rc.processGroup, os.Kill); err != nil {
+		_ = rc.cmd.Process.Kill()
+	}
+}
+
+// killProcessGroup tears down any processes left in the command's process
+// group once it has exited, escalating to a kill after the grace period.
+func (rc *RealCommand) killProcessGroup() {
+	if !rc.processGroup || !processGroupExists(rc.cmd.Process) {
+		return
+	}
+	_ = terminate(rc.cmd.Process, true)
+
+	deadline := time.Now().Add(rc.killGrace)
+	for processGroupExists(rc.cmd.Process) {
+		if time.Now().After(deadline) {
+			_ = signalProcess(rc.cmd.Process, true, os.Kill)
+			return
+		}
+		time.Sleep(groupPollInterval)
+	}
 }
 
 func (rc *RealCommand) SetStdout(w io.Writer) {
@@ -23,7 +173,52 @@ func (rc *RealCommand) SetStderr(w io.Writer) {
 	rc.cmd.Stderr = w
 }
 
-// NewRealCommandContext creates a RealCommand from exec.CommandContext
+func (rc *RealCommand) SetMaxRuntime(d time.Duration) {
+	rc.maxRuntime = d
+}
+
+func (rc *RealCommand) SetKillGrace(d time.Duration) {
+	rc.killGrace = d
+}
+
+func (rc *RealCommand) SetSignals(signals <-chan os.Signal) {
+	rc.signals = signals
+}
+
+func (rc *RealCommand) SetKillProcessGroup(enabled bool) {
+	rc.processGroup = enabled
+}
+
+func (rc *RealCommand) SetOrphanPolicy(policy OrphanPolicy) {
+	rc.orphanPolicy = policy
+}
+
+func (rc *RealCommand) SetStartHook(hook func(pgid int)) {
+	rc.startHook = hook
+}
+
+func (rc *RealCommand) Orphans() []string {
+	return rc.orphans
+}
+
+func (rc *RealCommand) ExitCode() int {
+	if rc.cmd.ProcessState == nil {
+		return -1
+	}
+	return rc.cmd.ProcessState.ExitCode()
+}
+
+func (rc *RealCommand) Signal() os.Signal {
+	if rc.cmd.ProcessState == nil {
+		return nil
+	}
+	if status, ok := rc.cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return status.Signal()
+	}
+	return nil
+}
+
+// NewRealCommandContext creates a RealCommand that is terminated when ctx is done
 func NewRealCommandContext(ctx context.Context, name string, args ...string) Command {
-	return &RealCommand{cmd: exec.CommandContext(ctx, name, args...)}
+	return &RealCommand{ctx: ctx, cmd: exec.Command(name, args...), orphanPolicy: OrphanIgnore}
 }
@@ -0,0 +1,238 @@
+//go:build linux
+
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTestCommand returns a RealCommand running script with sh, capturing its
+// stdout. Background processes must not inherit stdout, or Run waits for them
+// to close it
+func newTestCommand(ctx context.Context, script string) (*RealCommand, *bytes.Buffer) {
+	rc := NewRealCommandContext(ctx, "sh", "-c", script).(*RealCommand)
+	stdout := &bytes.Buffer{}
+	rc.SetStdout(stdout)
+	rc.SetKillGrace(200 * time.Millisecond)
+	return rc, stdout
+}
+
+// processGone reports whether the process with the given PID, or the process
+// group if it is negative, has exited and been reaped, waiting a few seconds
+// for init to reap it
+func processGone(pid int) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		// Collect it in case it was reparented to this process
+		_, _ = syscall.Wait4(pid, nil, syscall.WNOHANG, nil)
+		if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// outputPIDs parses the PIDs a test script printed, one per line
+func outputPIDs(t *testing.T, stdout *bytes.Buffer) []int {
+	t.Helper()
+	var pids []int
+	for _, field := range strings.Fields(stdout.String()) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			t.Fatalf("unexpected output %q", stdout.String())
+		}
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+func TestRealCommand_MaxRuntimeEscalatesToKill(t *testing.T) {
+	// The ignored SIGTERM is inherited by the sleep as well
+	rc, _ := newTestCommand(context.Background(), `trap "" TERM; sleep 100`)
+	rc.SetKillProcessGroup(true)
+	rc.SetMaxRuntime(100 * time.Millisecond)
+
+	start := time.Now()
+	err := rc.Run()
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, ErrMaxRuntimeExceeded) {
+		t.Fatalf("expected the max runtime to be exceeded, got %v", err)
+	}
+	if rc.Signal() != syscall.SIGKILL {
+		t.Errorf("expected the job to be killed, got signal %v", rc.Signal())
+	}
+	// Terminated after the max runtime, killed after the grace period
+	if elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("expected the job to be killed after about 300ms, took %s", elapsed)
+	}
+}
+
+func TestRealCommand_TearsDownProcessGroup(t *testing.T) {
+	rc, stdout := newTestCommand(context.Background(), `sleep 100 >/dev/null & echo $!`)
+	rc.SetKillProcessGroup(true)
+
+	if err := rc.Run(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pids := outputPIDs(t, stdout)
+	if len(pids) != 1 || !processGone(pids[0]) {
+		t.Errorf("expected the background sleep to be terminated, got %v", pids)
+	}
+	if !processGone(-rc.cmd.Process.Pid) {
+		t.Errorf("expected the process group to be gone")
+	}
+}
+
+func TestRealCommand_LeavesDaemons(t *testing.T) {
+	rc, stdout := newTestCommand(context.Background(), `sleep 100 >/dev/null & echo $!`)
+	rc.SetKillProcessGroup(false)
+	rc.SetOrphanPolicy(OrphanIgnore)
+
+	if err := rc.Run(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pids := outputPIDs(t, stdout)
+	if len(pids) != 1 {
+		t.Fatalf("expected one PID, got %v", pids)
+	}
+	defer processGone(pids[0])
+	defer syscall.Kill(pids[0], syscall.SIGKILL)
+	if err := syscall.Kill(pids[0], 0); err != nil {
+		t.Errorf("expected the daemon to keep running, got %v", err)
+	}
+	if len(rc.Orphans()) != 0 {
+		t.Errorf("expected no orphans, got %v", rc.Orphans())
+	}
+}
+
+func TestRealCommand_ReapsOrphans(t *testing.T) {
+	// The orphans leave the job's process group, so only reaping them as a
+	// subreaper catches them
+	rc, stdout := newTestCommand(context.Background(), `setsid sleep 100 >/dev/null & echo $!; setsid sleep 101 >/dev/null & echo $!`)
+	rc.SetKillProcessGroup(true)
+	rc.SetOrphanPolicy(OrphanKill)
+
+	if err := rc.Run(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !rc.subreaper {
+		t.Skip("child subreapers are not supported")
+	}
+	for _, pid := range outputPIDs(t, stdout) {
+		if !processGone(pid) {
+			t.Errorf("expected orphan %d to be terminated", pid)
+		}
+	}
+	orphans := slices.Sorted(slices.Values(rc.Orphans()))
+	if !slices.Equal(orphans, []string{"sleep 100", "sleep 101"}) {
+		t.Errorf("expected both sleeps to be recorded, got %v", orphans)
+	}
+}
+
+func TestRealCommand_LeavesOtherChildren(t *testing.T) {
+	// A child of this process that is not the job's must be neither
+	// signaled nor reaped, even once the job has orphans of its own
+	other := exec.Command("sleep", "30")
+	if err := other.Start(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer other.Wait()
+	defer other.Process.Kill()
+
+	rc, stdout := newTestCommand(context.Background(), `setsid sleep 100 >/dev/null & echo $!`)
+	rc.SetKillProcessGroup(true)
+	rc.SetOrphanPolicy(OrphanKill)
+
+	if err := rc.Run(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !rc.subreaper {
+		t.Skip("child subreapers are not supported")
+	}
+	for _, pid := range outputPIDs(t, stdout) {
+		if !processGone(pid) {
+			t.Errorf("expected orphan %d to be terminated", pid)
+		}
+	}
+	if !slices.Equal(rc.Orphans(), []string{"sleep 100"}) {
+		t.Errorf("expected only the job's orphan to be recorded, got %v", rc.Orphans())
+	}
+	if err := other.Process.Signal(syscall.Signal(0)); err != nil {
+		t.Errorf("expected the other child to keep running, got %v", err)
+	}
+
+	var set int32
+	if err := unix.Prctl(unix.PR_GET_CHILD_SUBREAPER, uintptr(unsafe.Pointer(&set)), 0, 0, 0); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if set != 0 {
+		t.Errorf("expected the child subreaper flag to be cleared")
+	}
+}
+
+func TestRealCommand_ForwardsSignals(t *testing.T) {
+	rc, _ := newTestCommand(context.Background(), `trap "exit 3" HUP; sleep 100 & wait`)
+	rc.SetKillProcessGroup(true)
+	signals := make(chan os.Signal, 1)
+	rc.SetSignals(signals)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		signals <- syscall.SIGHUP
+	}()
+	err := rc.Run()
+
+	var jobErr *JobExitError
+	if !errors.As(err, &jobErr) || jobErr.ExitCode != 3 {
+		t.Fatalf("expected the job to handle SIGHUP and exit 3, got %v", err)
+	}
+}
+
+func TestRealCommand_CanceledContextStopsJob(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	rc, _ := newTestCommand(ctx, `sleep 100`)
+	rc.SetKillProcessGroup(true)
+
+	if err := rc.Run(); err == nil {
+		t.Fatalf("expected the job to be terminated")
+	}
+	if rc.Signal() != syscall.SIGTERM {
+		t.Errorf("expected SIGTERM to be enough, got signal %v", rc.Signal())
+	}
+}
+
+func TestRealCommand_StartHookReportsProcessGroup(t *testing.T) {
+	for _, group := range []bool{true, false} {
+		rc, stdout := newTestCommand(context.Background(), `cut -d" " -f5 /proc/$$/stat`)
+		rc.SetKillProcessGroup(group)
+		reported := -1
+		rc.SetStartHook(func(pgid int) { reported = pgid })
+
+		if err := rc.Run(); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		expected := 0
+		if group {
+			expected = outputPIDs(t, stdout)[0]
+		}
+		if reported != expected {
+			t.Errorf("with its own process group %t, expected %d to be reported, got %d", group, expected, reported)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+//go:build linux
+
+package command
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// subreaperMu guards the child subreaper flag, which jobs run at once
+	// share
+	subreaperMu sync.Mutex
+	// subreaperUsers counts the jobs running with the flag set
+	subreaperUsers int
+	// subreaperWasSet records whether the flag was set before the first of
+	// them, in which case it is left set
+	subreaperWasSet bool
+)
+
+// enableSubreaper marks this process as a child subreaper, so that orphaned
+// descendants of the job are reparented to it rather than to init. Unless it
+// returns false, disableSubreaper must be called once the job's orphans have
+// been handled.
+func enableSubreaper() bool {
+	subreaperMu.Lock()
+	defer subreaperMu.Unlock()
+	if subreaperUsers == 0 {
+		var set int32
+		if err := unix.Prctl(unix.PR_GET_CHILD_SUBREAPER, uintptr(unsafe.Pointer(&set)), 0, 0, 0); err != nil {
+			return false
+		}
+		subreaperWasSet = set != 0
+		if !subreaperWasSet {
+			if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+				return false
+			}
+		}
+	}
+	subreaperUsers++
+	return true
+}
+
+// disableSubreaper clears the child subreaper flag once no job needs it,
+// unless it was set before.
+func disableSubreaper() {
+	subreaperMu.Lock()
+	defer subreaperMu.Unlock()
+	subreaperUsers--
+	if subreaperUsers == 0 && !subreaperWasSet {
+		_ = unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 0, 0, 0, 0)
+	}
+}
+
+// reapChild collects the exit status of the child with the given PID if it
+// has exited, and reports whether it is gone.
+func reapChild(pid int) bool {
+	var status syscall.WaitStatus
+	reaped, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil)
+	return reaped == pid || errors.Is(err, syscall.ECHILD)
+}
+
+// processTable returns the processes running on the host, keyed by PID.
+func processTable() map[int]processInfo {
+	table := make(map[int]processInfo)
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	for _, stat := range stats {
+		data, err := os.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+		// The command name is in parentheses and may itself contain spaces
+		// or parentheses, so parse the fields after the last one, starting
+		// with the state.
+		fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+		if len(fields) < 20 {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		start, err := strconv.ParseUint(fields[19], 10, 64)
+		if err != nil {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(stat)))
+		if err != nil {
+			continue
+		}
+		table[pid] = processInfo{ppid: ppid, start: start}
+	}
+	return table
+}
+
+// hasEnv reports whether the environment the process with the given PID was
+// started with includes entry.
+func hasEnv(pid int, entry string) bool {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "environ"))
+	if err != nil {
+		return false
+	}
+	for _, env := range strings.Split(string(data), "\x00") {
+		if env == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// commandLine returns the command line of the process with the given PID.
+func commandLine(pid int) string {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil || len(data) == 0 {
+		return "[" + strconv.Itoa(pid) + "]"
+	}
+	return strings.Join(strings.Split(strings.TrimRight(string(data), "\x00"), "\x00"), " ")
+}
+
+// signalPid sends sig to the process with the given PID.
+func signalPid(pid int, sig syscall.Signal) error {
+	return syscall.Kill(pid, sig)
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+
+package command
+
+import "syscall"
+
+// enableSubreaper reports false as child subreapers are only supported on
+// Linux.
+func enableSubreaper() bool {
+	return false
+}
+
+func disableSubreaper() {}
+
+func reapChild(pid int) bool {
+	return true
+}
+
+func processTable() map[int]processInfo {
+	return nil
+}
+
+func hasEnv(pid int, entry string) bool {
+	return false
+}
+
+func commandLine(pid int) string {
+	return ""
+}
+
+func signalPid(pid int, sig syscall.Signal) error {
+	return nil
+}
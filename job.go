@@ -0,0 +1,246 @@
+package jobwrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+	"github.com/jacobalberty/jobwrapper/history"
+	"github.com/jacobalberty/jobwrapper/internal/command"
+	"github.com/jacobalberty/jobwrapper/lock"
+)
+
+// job holds everything needed to lock and execute a single invocation of
+// jobwrapper.
+type job struct {
+	cfg          config.Config // merged settings of the job's groups
+	lockCfg      config.Config // settings of the groups' locks, by lock key
+	groups       []string
+	cmd          string
+	cmdArgs      []string
+	stdout       io.Writer
+	stderr       io.Writer
+	locker       lock.Locker
+	jobSlots     lock.JobLimiter   // nil unless max_jobs is set
+	staleHolders lock.HolderLister // nil unless a group sets stale_after
+	holder       lock.Holder
+	fs           filesystem.FileSystem
+	result       *history.Result // the attempt being recorded in the history
+	relay        *signalRelay
+	commandCtx   command.CommandContextFunc
+	orphanPolicy command.OrphanPolicy
+	onLocked     onLockedPolicy
+}
+
+// acquireLock acquires the lock of every group in order, followed by a job
+// slot if max_jobs is set, waiting at most the configured timeout for all of
+// them. Unless the on_locked policy is to wait, each group's lock is tried
+// once, while the job slot is still waited for within the timeout, as a host
+// at max_jobs only delays the job. If any lock cannot be acquired the ones
+// already held are released, so the job holds either all of its locks or none.
+func (j *job) acquireLock(ctx context.Context) error {
+	timeout := j.cfg.Timeout
+	if j.onLocked != onLockedWait {
+		timeout = 0
+	}
+	lockCtx, lockCancel := context.WithTimeout(ctx, timeout)
+	defer lockCancel()
+	slotCtx := lockCtx
+	if j.onLocked != onLockedWait {
+		var slotCancel context.CancelFunc
+		slotCtx, slotCancel = context.WithTimeout(ctx, j.cfg.Timeout)
+		defer slotCancel()
+	}
+
+	stopWatching := j.watchStale(lockCtx)
+	group, err := j.acquireGroups(lockCtx)
+	stopWatching()
+	if err != nil {
+		if errors.Is(err, lock.ErrLockTimeout) {
+			j.markHeldBy(group)
+		}
+		return j.lockError(err, j.onLocked == onLockedSkip)
+	}
+
+	// The job slot is taken last, so that jobs waiting for their groups do
+	// not hold up jobs in other groups
+	if j.jobSlots != nil {
+		start := time.Now()
+		err := j.jobSlots.AcquireJobSlot(slotCtx)
+		wait := time.Since(start)
+		j.result.JobSlotWait = &wait
+		if err != nil {
+			j.release(j.groups)
+			return j.lockError(fmt.Errorf("error acquiring a job slot: %w", err), false)
+		}
+	}
+	return nil
+}
+
+// acquireGroups acquires the lock of every group in order, releasing those
+// already held if one cannot be acquired. It returns the group that could not
+// be acquired along with the error.
+func (j *job) acquireGroups(ctx context.Context) (string, error) {
+	for i, group := range j.groups {
+		if err := j.locker.Acquire(ctx, group); err != nil {
+			j.release(j.groups[:i])
+			return group, fmt.Errorf("error acquiring lock for group '%s': %w", group, err)
+		}
+	}
+	return "", nil
+}
+
+// markHeldBy records in the history who holds a group the job could not
+// acquire, where the lock backend can tell.
+func (j *job) markHeldBy(group string) {
+	lister, ok := j.locker.(lock.HolderLister)
+	if !ok {
+		return
+	}
+	holders, err := lister.Holders(group)
+	if err != nil || len(holders) == 0 {
+		return
+	}
+	heldBy := make([]string, len(holders))
+	for i, holder := range holders {
+		heldBy[i] = fmt.Sprintf("run %s (pid %d on %s)", holder.RunID, holder.PID, holder.Hostname)
+	}
+	j.result.HeldBy = heldBy
+}
+
+// lockError records why the locks could not be acquired in the history and
+// sets the exit status accordingly. A timeout skips the run if skip is set.
+func (j *job) lockError(err error, skip bool) error {
+	if sig := j.relay.lastSignal(); sig != nil {
+		j.killed(fmt.Sprintf("terminated by signal %s before the job started", sig))
+		return withExitCode(signalExitCode(sig), err)
+	}
+	if errors.Is(err, lock.ErrLockTimeout) {
+		if skip {
+			j.result.Status = history.StatusSkipped
+			return withExitCode(exitSkipped, fmt.Errorf("%w: %w", ErrJobSkipped, err))
+		}
+		j.result.Status = history.StatusLockTimeout
+	}
+	return err
+}
+
+// killed records in the history that the wrapper killed the job, and why.
+func (j *job) killed(reason string) {
+	j.result.Status = history.StatusKilled
+	j.result.Killed = reason
+}
+
+// releaseLock releases the job slot and the locks of every group.
+func (j *job) releaseLock() {
+	if j.jobSlots != nil {
+		if err := j.jobSlots.ReleaseJobSlot(); err != nil {
+			fmt.Fprintf(j.stderr, "Error releasing job slot: %v\n", err)
+		}
+	}
+	j.release(j.groups)
+}
+
+// release releases the locks of groups in the reverse of the order they were
+// acquired, reporting any failure on stderr.
+func (j *job) release(groups []string) {
+	for _, group := range slices.Backward(groups) {
+		if err := j.locker.Release(group); err != nil {
+			fmt.Fprintf(j.stderr, "Error releasing lock for group '%s': %v\n", group, err)
+		}
+	}
+}
+
+// execute runs the job once and records the outcome in the history. If the
+// lock backend loses the job's locks while it runs, the job is terminated.
+func (j *job) execute(ctx context.Context) error {
+	j.result.ExecutionStart = time.Now()
+
+	if notifier, ok := j.locker.(lock.LossNotifier); ok {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		lost := notifier.Lost()
+		go func() {
+			select {
+			case <-lost:
+				cancel(ErrLockLost)
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	cmdCtx := j.commandCtx(ctx, j.cmd, j.cmdArgs...)
+	cmdCtx.SetStdout(j.stdout)
+	cmdCtx.SetStderr(j.stderr)
+	cmdCtx.SetMaxRuntime(time.Duration(j.cfg.MaxRuntime))
+	cmdCtx.SetKillGrace(time.Duration(j.cfg.KillGrace))
+	cmdCtx.SetKillProcessGroup(j.cfg.KillProcessGroup)
+	cmdCtx.SetOrphanPolicy(j.orphanPolicy)
+	cmdCtx.SetSignals(j.relay.jobStarted())
+	defer j.relay.jobFinished()
+	cmdCtx.SetStartHook(j.recordProcessGroup)
+	// Locks taken for a later attempt are held by this process until its
+	// job starts
+	defer j.locker.SetHolder(j.holder)
+
+	err := cmdCtx.Run()
+	exitCode := cmdCtx.ExitCode()
+	j.result.ExecutionEnd = time.Now()
+	j.result.ExitCode = &exitCode
+	j.result.Signal = cmdCtx.Signal()
+	j.result.Orphans = cmdCtx.Orphans()
+
+	if err != nil {
+		if errors.Is(err, command.ErrMaxRuntimeExceeded) {
+			j.killed(fmt.Sprintf("exceeded max runtime of %s", time.Duration(j.cfg.MaxRuntime)))
+		} else if errors.Is(context.Cause(ctx), ErrLockLost) {
+			j.killed(ErrLockLost.Error())
+			err = fmt.Errorf("%w: %w", ErrLockLost, err)
+		} else if sig := j.relay.lastSignal(); sig != nil {
+			j.killed(fmt.Sprintf("terminated by signal %s", sig))
+		}
+		var jobErr *command.JobExitError
+		if !errors.As(err, &jobErr) {
+			// The job never ran
+			err = withExitCode(startFailureCode(err), err)
+		}
+		return fmt.Errorf("job execution for script '%s' failed: %w", j.cmd, err)
+	}
+
+	return nil
+}
+
+// recordProcessGroup records the process group of the started job as that of
+// the holder of the job's locks, so that a job that finds it stale signals
+// the job rather than this process, which then releases the locks. A job
+// without a process group of its own shares this process's, which is
+// recorded already.
+func (j *job) recordProcessGroup(pgid int) {
+	updater, ok := j.locker.(lock.HolderUpdater)
+	if !ok || pgid == 0 {
+		return
+	}
+	holder := j.holder
+	holder.PGID = pgid
+	if err := updater.UpdateHolder(holder); err != nil {
+		fmt.Fprintf(j.stderr, "Error recording the job's process group: %v\n", err)
+	}
+}
+
+// attempt locks the group if it is not already held across attempts and
+// executes the job.
+func (j *job) attempt(ctx context.Context) error {
+	if j.cfg.Retry.ReleaseLock {
+		if err := j.acquireLock(ctx); err != nil {
+			return err
+		}
+		defer j.releaseLock()
+	}
+	return j.execute(ctx)
+}
@@ -0,0 +1,224 @@
+// Package jobwrapper runs a job under a named group lock, recording the
+// outcome of each run in a history file. It is the implementation of the
+// jobwrapper command, for Go programs that embed the wrapper.
+package jobwrapper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+	"github.com/jacobalberty/jobwrapper/history"
+	"github.com/jacobalberty/jobwrapper/internal/command"
+	"github.com/jacobalberty/jobwrapper/lock"
+)
+
+// Run runs jobwrapper with the given command line arguments, not including
+// the program name, exactly as the jobwrapper command does: it loads the
+// configuration from ~/.jobwrapper, locks the job's groups, runs the job and
+// records its history. The job's output is written to stdout and stderr.
+//
+// While the job runs, the signals in forward_signals are caught and relayed
+// to it rather than terminating the calling program. The returned error can
+// be inspected with errors.Is and errors.As against the errors of this
+// package, and ExitCode gives the status the jobwrapper command would exit
+// with.
+func Run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	return run(ctx, args, stdout, stderr, filesystem.OSFileSystem{}, lock.NewLocker, command.NewRealCommandContext)
+}
+
+func run(
+	ctx context.Context,
+	args []string,
+	stdout io.Writer,
+	stderr io.Writer,
+	fs filesystem.FileSystem,
+	lockFactory lock.LockFactory,
+	commandCtx command.CommandContextFunc,
+) (err error) {
+	var (
+		historyWriter history.HistoryWriter
+		locker        lock.Locker
+	)
+	if len(args) > 0 && args[0] == reservedGroup {
+		return runLocks(args[1:], stdout, stderr, fs, lockFactory)
+	}
+	opts, err := parseArgs(args, stderr)
+	if err != nil {
+		return err
+	}
+	cmd := opts.cmd
+	cmdArgs := opts.cmdArgs
+
+	// Load configuration
+	cfg, err := config.LoadConfig(fs)
+	if err != nil {
+		return err
+	}
+	groups, lockCfg, err := lockKeys(cfg, opts.groups, cmdArgs, os.LookupEnv)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	// The job runs with the merged settings of its groups, while the settings
+	// of each group's lock are left to the locker
+	cfg = cfg.ForGroups(opts.groups)
+
+	// Catch signals so they can be forwarded to the job and the run always
+	// ends with its history written and its lock released
+	relay, ctx, err := newSignalRelay(ctx, cfg.ForwardSignals)
+	if err != nil {
+		return fmt.Errorf("%w: forward_signals: %w", config.ErrConfigInvalid, err)
+	}
+	defer relay.stop()
+
+	orphanPolicy, err := command.ParseOrphanPolicy(cfg.OrphanPolicy)
+	if err != nil {
+		return fmt.Errorf("%w: orphan_policy: %w", config.ErrConfigInvalid, err)
+	}
+
+	onLocked, err := parseOnLocked(cfg.OnLocked)
+	if err != nil {
+		return fmt.Errorf("%w: on_locked: %w", config.ErrConfigInvalid, err)
+	}
+	if opts.noWait {
+		onLocked = onLockedSkip
+	}
+
+	watchStale := false
+	for _, group := range groups {
+		gc := lockCfg.ForGroup(group)
+		if _, err := parseStaleAction(gc.StaleAction); err != nil {
+			return fmt.Errorf("%w: stale_action: %w", config.ErrConfigInvalid, err)
+		}
+		watchStale = watchStale || gc.StaleAfter > 0
+	}
+
+	// Create the locker of the configured backend
+	locker, err = lockFactory(&lockCfg, fs)
+	if err != nil {
+		return err
+	}
+	if closer, ok := locker.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	var jobSlots lock.JobLimiter
+	if cfg.MaxJobs > 0 {
+		var ok bool
+		if jobSlots, ok = locker.(lock.JobLimiter); !ok {
+			return fmt.Errorf("%w: max_jobs: not supported by the lock backend", config.ErrConfigInvalid)
+		}
+	}
+
+	sharedLocker, canShare := locker.(lock.SharedLocker)
+	if opts.mode == lock.ModeShared && !canShare {
+		return fmt.Errorf("%w: --shared: not supported by the lock backend", config.ErrConfigInvalid)
+	}
+	prioritizer, canPrioritize := locker.(lock.Prioritizer)
+	if !canPrioritize {
+		if opts.priority != nil {
+			return fmt.Errorf("%w: --priority: not supported by the lock backend", config.ErrConfigInvalid)
+		}
+		for _, group := range groups {
+			if lockCfg.ForGroup(group).Priority != 0 {
+				return fmt.Errorf("%w: priority: not supported by the lock backend", config.ErrConfigInvalid)
+			}
+		}
+	}
+
+	var staleHolders lock.HolderLister
+	if watchStale {
+		var ok bool
+		if staleHolders, ok = locker.(lock.HolderLister); !ok {
+			return fmt.Errorf("%w: stale_after: not supported by the lock backend", config.ErrConfigInvalid)
+		}
+	}
+
+	historyWriter, err = history.NewWriter(fs, &cfg, cmd, cmdArgs)
+	if err != nil {
+		return fmt.Errorf("error creating history writer: %w", err)
+	}
+	result := &history.Result{
+		RunID:   history.NewRunID(),
+		Attempt: 1,
+		Start:   time.Now(),
+		Groups:  groups,
+	}
+	defer func() {
+		result.Err = err
+		if historyErr := historyWriter.WriteHistory(*result); historyErr != nil {
+			fmt.Fprintf(stderr, "Error writing history: %v\n", historyErr)
+			if err == nil {
+				err = historyErr
+			}
+		}
+	}()
+
+	holder := lock.NewHolder(result.RunID, append([]string{cmd}, cmdArgs...))
+	locker.SetHolder(holder)
+	if canShare {
+		sharedLocker.SetMode(opts.mode)
+	}
+	if opts.priority != nil {
+		prioritizer.SetPriority(*opts.priority)
+	}
+
+	j := &job{
+		cfg:          cfg,
+		lockCfg:      lockCfg,
+		groups:       groups,
+		cmd:          cmd,
+		cmdArgs:      cmdArgs,
+		stdout:       stdout,
+		stderr:       stderr,
+		locker:       locker,
+		jobSlots:     jobSlots,
+		staleHolders: staleHolders,
+		holder:       holder,
+		fs:           fs,
+		result:       result,
+		relay:        relay,
+		commandCtx:   commandCtx,
+		orphanPolicy: orphanPolicy,
+		onLocked:     onLocked,
+	}
+
+	// Hold the lock across all attempts unless configured to release it
+	// between them
+	if !cfg.Retry.ReleaseLock {
+		if err = j.acquireLock(ctx); err != nil {
+			return err
+		}
+		defer j.releaseLock()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = j.attempt(ctx)
+		if err == nil || attempt >= cfg.Retry.MaxAttempts || !shouldRetry(cfg.Retry, err) {
+			return err
+		}
+
+		delay := retryBackoff(cfg.Retry, attempt)
+		fmt.Fprintf(stderr, "Attempt %d of %d failed: %v; retrying in %s\n", attempt, cfg.Retry.MaxAttempts, err, delay)
+		result.Err = err
+		if historyErr := historyWriter.WriteHistory(*result); historyErr != nil {
+			fmt.Fprintf(stderr, "Error writing history: %v\n", historyErr)
+		}
+		*result = result.NextAttempt()
+
+		select {
+		case <-ctx.Done():
+			err = fmt.Errorf("retry of script '%s' canceled: %w", cmd, ctx.Err())
+			if sig := relay.lastSignal(); sig != nil {
+				j.killed(fmt.Sprintf("terminated by signal %s before the job started", sig))
+				return withExitCode(signalExitCode(sig), err)
+			}
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
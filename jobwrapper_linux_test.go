@@ -0,0 +1,104 @@
+//go:build linux
+
+package jobwrapper
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/internal/command"
+	"github.com/jacobalberty/jobwrapper/lock"
+)
+
+func TestRun_RecordsReapedOrphans(t *testing.T) {
+	fs := configFileSystem(t, "kill_grace = \"200ms\"\n")
+	fs.OpenFileFunc = nil
+	fs.Files = make(map[string]*string)
+	mocks := testSetup(t, fs, nil, command.NewRealCommandContext)
+
+	// The orphan leaves the job's process group and its output, so only
+	// reaping it as a subreaper catches it
+	args := []string{"backup", "sh", "-c", "setsid sleep 100 >/dev/null 2>&1 &"}
+	if err := run(context.Background(), args, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, mocks.Locker, mocks.CommandContext); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var entry string
+	for name, content := range fs.Files {
+		if strings.HasSuffix(name, "sh.log") {
+			entry = *content
+		}
+	}
+	if !strings.Contains(entry, `"orphans_reaped":1,"orphans":["sleep 100"]`) {
+		t.Errorf("Expected the history to record the reaped orphan, got %q", entry)
+	}
+}
+
+func TestRun_StaleHolderSignaled(t *testing.T) {
+	// The stale job runs in a process group of its own, and is stopped so
+	// that only continuing it lets it handle SIGTERM
+	job := exec.Command("sleep", "100")
+	job.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := job.Start(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- job.Wait() }()
+	defer job.Process.Kill()
+	if err := syscall.Kill(job.Process.Pid, syscall.SIGSTOP); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	hostname, _ := os.Hostname()
+	stale := lock.Holder{
+		PID:      job.Process.Pid,
+		PGID:     job.Process.Pid,
+		Hostname: hostname,
+		Command:  []string{"/mock/other.sh"},
+		RunID:    "0123456789abcdef",
+		Started:  time.Now().Add(-2 * time.Hour),
+		Acquired: time.Now().Add(-time.Hour),
+	}
+	// The groups are checked in order, so once db is checked the stale
+	// holder of backup has been dealt with
+	checked := make(chan struct{})
+	var once sync.Once
+	mockLocker := lock.NewMockLocker()
+	mockLocker.HoldersFunc = func(lockName string) ([]lock.Holder, error) {
+		if lockName == "db" {
+			once.Do(func() { close(checked) })
+			return nil, nil
+		}
+		return []lock.Holder{stale}, nil
+	}
+	mockLocker.AcquireFunc = func(lockName string) error {
+		<-checked
+		return nil
+	}
+	mockLocker.ReleaseFunc = func(lockName string) error { return nil }
+	mocks := testSetup(t, configFileSystem(t, "stale_after = \"30m\"\nstale_action = \"term\"\n"), mockLocker, nil)
+
+	stderr := &bytes.Buffer{}
+	if err := run(context.Background(), []string{"backup,db", "/mock/script.sh"}, &bytes.Buffer{}, stderr, mocks.FileSystem, mocks.Locker, mocks.CommandContext); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.Contains(stderr.String(), "sent SIGTERM to process group") {
+		t.Errorf("Expected the stale holder to be signaled, got %q", stderr.String())
+	}
+
+	select {
+	case err := <-exited:
+		if status, ok := job.ProcessState.Sys().(syscall.WaitStatus); !ok || status.Signal() != syscall.SIGTERM {
+			t.Errorf("Expected the stale job to be terminated, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the stale job to be terminated")
+	}
+}
@@ -0,0 +1,913 @@
+package jobwrapper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+	"github.com/jacobalberty/jobwrapper/internal/command"
+	"github.com/jacobalberty/jobwrapper/lock"
+)
+
+func TestRun_WithMocks(t *testing.T) {
+	testCases := []struct {
+		name              string
+		mockConfig        string
+		expectedCmdStdout string
+		expectedCmdStderr string
+		lockExists        bool
+		expectError       bool
+		setupMocks        func(context.Context) TestMocks                             // The test setup function can return specific mocks if needed
+		expectHandler     func(t *testing.T, stdout, stderr *bytes.Buffer, err error) // Optional custom handler for specific tests
+	}{
+		{
+			name: "Successful Command Execution",
+			mockConfig: `
+                lock_dir = "/mock/lockdir"
+                timeout = 60
+                lock_filename = ".mocklock"
+                history_lines = 5
+            `,
+			expectedCmdStdout: "Hello, world!\n", // Expected stdout content
+			expectedCmdStderr: "",
+			lockExists:        false,
+			expectError:       false,
+			setupMocks: func(ctx context.Context) TestMocks {
+				return testSetup(t, nil, nil, func(ctx context.Context, name string, args ...string) command.Command {
+					return &command.MockCommand{
+						StdoutContent: "Hello, world!\n",
+						StderrContent: "",
+						RunFunc:       func() error { return nil },
+					}
+				})
+			},
+			expectHandler: nil, // No custom handler, use default
+		},
+		{
+			name: "Command Fails with Error",
+			mockConfig: `
+                lock_dir = "/mock/lockdir"
+                timeout = 60
+                lock_filename = ".mocklock"
+                history_lines = 5
+            `,
+			expectedCmdStdout: "",
+			expectedCmdStderr: "Command failed\n", // Expected stderr content
+			lockExists:        false,
+			expectError:       true,
+			setupMocks: func(ctx context.Context) TestMocks {
+				return testSetup(t, nil, nil, func(ctx context.Context, name string, args ...string) command.Command {
+					return &command.MockCommand{
+						StdoutContent: "",
+						StderrContent: "Command failed\n",
+						RunFunc:       func() error { return fmt.Errorf("mock command error") }, // Simulate command failure
+					}
+				})
+			},
+			expectHandler: nil, // No custom handler, use default
+		},
+		{
+			name: "Command Exceeds Max Runtime",
+			mockConfig: `
+                lock_dir = "/mock/lockdir"
+                timeout = 60
+                lock_filename = ".mocklock"
+                history_lines = 5
+                max_runtime = "1s"
+            `,
+			expectedCmdStdout: "",
+			expectedCmdStderr: "",
+			lockExists:        false,
+			expectError:       true,
+			setupMocks: func(ctx context.Context) TestMocks {
+				return testSetup(t, nil, nil, func(ctx context.Context, name string, args ...string) command.Command {
+					return &command.MockCommand{
+						RunFunc: func() error {
+							return fmt.Errorf("%w (1s): signal: terminated", command.ErrMaxRuntimeExceeded)
+						},
+					}
+				})
+			},
+			expectHandler: func(t *testing.T, stdout, stderr *bytes.Buffer, err error) {
+				if !errors.Is(err, command.ErrMaxRuntimeExceeded) {
+					t.Errorf("Expected max runtime error, got '%v'", err)
+				}
+			},
+		},
+		{
+			name: "Command Exit Status Is Passed Through",
+			mockConfig: `
+                lock_dir = "/mock/lockdir"
+                timeout = 60
+                lock_filename = ".mocklock"
+                history_lines = 5
+            `,
+			expectedCmdStdout: "",
+			expectedCmdStderr: "",
+			lockExists:        false,
+			expectError:       true,
+			setupMocks: func(ctx context.Context) TestMocks {
+				return testSetup(t, nil, nil, func(ctx context.Context, name string, args ...string) command.Command {
+					return &command.MockCommand{
+						ExitStatus: 3,
+						RunFunc:    func() error { return fmt.Errorf("exit status 3") },
+					}
+				})
+			},
+			expectHandler: func(t *testing.T, stdout, stderr *bytes.Buffer, err error) {
+				if code := ExitCode(err); code != 3 {
+					t.Errorf("Expected exit code 3, got %d", code)
+				}
+			},
+		},
+		{
+			name: "Command Terminated By Signal",
+			mockConfig: `
+                lock_dir = "/mock/lockdir"
+                timeout = 60
+                lock_filename = ".mocklock"
+                history_lines = 5
+            `,
+			expectedCmdStdout: "",
+			expectedCmdStderr: "",
+			lockExists:        false,
+			expectError:       true,
+			setupMocks: func(ctx context.Context) TestMocks {
+				return testSetup(t, nil, nil, func(ctx context.Context, name string, args ...string) command.Command {
+					return &command.MockCommand{
+						ExitStatus: -1,
+						ExitSignal: syscall.SIGKILL,
+						RunFunc:    func() error { return fmt.Errorf("signal: killed") },
+					}
+				})
+			},
+			expectHandler: func(t *testing.T, stdout, stderr *bytes.Buffer, err error) {
+				if code := ExitCode(err); code != 128+int(syscall.SIGKILL) {
+					t.Errorf("Expected exit code %d, got %d", 128+int(syscall.SIGKILL), code)
+				}
+			},
+		},
+		{
+			name: "Lock Already Exists",
+			mockConfig: `
+                lock_dir = "/mock/lockdir"
+                timeout = 60
+                lock_filename = ".mocklock"
+                history_lines = 5
+            `,
+			expectedCmdStdout: "",
+			expectedCmdStderr: "",
+			lockExists:        true, // Simulate lock already exists
+			expectError:       true,
+			setupMocks: func(ctx context.Context) TestMocks {
+				mockLocker := lock.NewMockLocker()
+				if err := mockLocker.Acquire(ctx, "backup"); err != nil {
+					t.Fatalf("Failed to acquire lock: %v", err)
+				}
+				return testSetup(t, nil, mockLocker, nil)
+			},
+			expectHandler: func(t *testing.T, stdout, stderr *bytes.Buffer, err error) {
+				if err == nil {
+					t.Fatalf("Expected an error but got none")
+				}
+				if !strings.Contains(err.Error(), "error acquiring lock") {
+					t.Errorf("Expected lock acquisition error, got '%v'", err)
+				}
+				if code := ExitCode(err); code != exitWrapperFailure {
+					t.Errorf("Expected exit code %d, got %d", exitWrapperFailure, code)
+				}
+				if stdout.String() != "" {
+					t.Errorf("Expected empty stdout, got '%s'", stdout.String())
+				}
+				if stderr.String() != "" {
+					t.Errorf("Expected empty stderr, got '%s'", stderr.String())
+				}
+			},
+		},
+		{
+			name: "Lock Acquisition Times Out",
+			mockConfig: `
+                lock_dir = "/mock/lockdir"
+                timeout = 60
+                lock_filename = ".mocklock"
+                history_lines = 5
+            `,
+			expectedCmdStdout: "",
+			expectedCmdStderr: "",
+			lockExists:        true,
+			expectError:       true,
+			setupMocks: func(ctx context.Context) TestMocks {
+				mockLocker := lock.NewMockLocker()
+				mockLocker.AcquireFunc = func(lockName string) error {
+					return fmt.Errorf("%w %s: %w", lock.ErrLockTimeout, lockName, context.DeadlineExceeded)
+				}
+				return testSetup(t, nil, mockLocker, nil)
+			},
+			expectHandler: func(t *testing.T, stdout, stderr *bytes.Buffer, err error) {
+				if !errors.Is(err, lock.ErrLockTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("Expected lock timeout error, got '%v'", err)
+				}
+				if code := ExitCode(err); code != exitLockTimeout {
+					t.Errorf("Expected exit code %d, got %d", exitLockTimeout, code)
+				}
+			},
+		},
+		{
+			name: "Custom Config with Timeout",
+			mockConfig: `
+                lock_dir = "/custom/lockdir"
+                timeout = 120
+                lock_filename = ".customlock"
+                history_lines = 7
+            `,
+			expectedCmdStdout: "Delayed output\n", // Simulate delayed output
+			expectedCmdStderr: "",
+			lockExists:        false,
+			expectError:       false,
+			setupMocks: func(ctx context.Context) TestMocks {
+				return testSetup(t, nil, nil, func(ctx context.Context, name string, args ...string) command.Command {
+					return &command.MockCommand{
+						StdoutContent: "Delayed output\n",
+						StderrContent: "",
+						RunFunc: func() error {
+							time.Sleep(500 * time.Millisecond) // Simulate a delay
+							return nil
+						},
+					}
+				})
+			},
+			expectHandler: nil, // No custom handler, use default
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+
+			mocks := tc.setupMocks(ctx)
+
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+			args := []string{"backup", "/mock/script.sh"}
+
+			err := run(ctx, args, stdout, stderr, mocks.FileSystem, mocks.Locker, mocks.CommandContext)
+
+			// Default checks for stdout, stderr, and error
+			if stdout.String() != tc.expectedCmdStdout {
+				t.Errorf("Expected stdout to be '%s', got '%s'", tc.expectedCmdStdout, stdout.String())
+			}
+
+			if stderr.String() != tc.expectedCmdStderr {
+				t.Errorf("Expected stderr to be '%s', got '%s'", tc.expectedCmdStderr, stderr.String())
+			}
+
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("Expected an error but got none")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Expected no error but got: %v", err)
+				}
+			}
+
+			// Run custom handler if provided
+			if tc.expectHandler != nil {
+				tc.expectHandler(t, stdout, stderr, err)
+			}
+		})
+	}
+}
+
+func TestSignalRelay(t *testing.T) {
+	relay, ctx, err := newSignalRelay(context.Background(), []string{"SIGHUP"})
+	if err != nil {
+		t.Fatalf("Failed to create signal relay: %v", err)
+	}
+	defer relay.stop()
+
+	// Before the job starts a signal cancels the run
+	relay.caught <- syscall.SIGHUP
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Expected context to be canceled")
+	}
+	if sig := relay.lastSignal(); sig != syscall.SIGHUP {
+		t.Errorf("Expected last signal to be SIGHUP, got %v", sig)
+	}
+
+	// Once it has started signals are forwarded to it
+	forward := relay.jobStarted()
+	relay.caught <- syscall.SIGTERM
+	select {
+	case sig := <-forward:
+		if sig != syscall.SIGTERM {
+			t.Errorf("Expected SIGTERM to be forwarded, got %v", sig)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected signal to be forwarded")
+	}
+
+	if _, _, err := newSignalRelay(context.Background(), []string{"SIGBOGUS"}); err == nil {
+		t.Errorf("Expected an error for an unknown signal")
+	}
+}
+
+func TestRun_RetriesFailedCommand(t *testing.T) {
+	attempts := 0
+	fs := configFileSystem(t, `
+        [groups.backup.retry]
+        max_attempts = 3
+        initial_backoff = "1ms"
+        retryable_exit_codes = [75]
+    `)
+	mocks := testSetup(t, fs, nil, func(ctx context.Context, name string, args ...string) command.Command {
+		attempts++
+		if attempts < 3 {
+			return &command.MockCommand{
+				ExitStatus: 75,
+				RunFunc:    func() error { return fmt.Errorf("exit status 75") },
+			}
+		}
+		return &command.MockCommand{}
+	})
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	args := []string{"backup", "/mock/script.sh"}
+
+	if err := run(context.Background(), args, stdout, stderr, mocks.FileSystem, mocks.Locker, mocks.CommandContext); err != nil {
+		t.Fatalf("Expected no error but got: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+	if !strings.Contains(stderr.String(), "Attempt 2 of 3 failed") {
+		t.Errorf("Expected retries to be reported on stderr, got '%s'", stderr.String())
+	}
+}
+
+func TestRun_DoesNotRetryAfterLockLost(t *testing.T) {
+	attempts := 0
+	fs := configFileSystem(t, `
+        [groups.backup.retry]
+        max_attempts = 3
+        initial_backoff = "1ms"
+        retryable_exit_codes = [75]
+    `)
+	mockLocker := lock.NewMockLocker()
+	mockLocker.LostCh = make(chan struct{})
+	mocks := testSetup(t, fs, mockLocker, func(ctx context.Context, name string, args ...string) command.Command {
+		attempts++
+		return &command.MockCommand{
+			ExitStatus: 75,
+			RunFunc: func() error {
+				if attempts == 1 {
+					close(mockLocker.LostCh)
+				}
+				<-ctx.Done()
+				return fmt.Errorf("exit status 75")
+			},
+		}
+	})
+
+	err := run(context.Background(), []string{"backup", "/mock/script.sh"}, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, mocks.Locker, mocks.CommandContext)
+
+	if !errors.Is(err, ErrLockLost) {
+		t.Fatalf("Expected the job to fail as its lock was lost, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected a job that lost its lock not to be retried, got %d attempts", attempts)
+	}
+}
+
+func TestRun_NoWaitSkipsLockedGroup(t *testing.T) {
+	mockLocker := lock.NewMockLocker()
+	mockLocker.AcquireFunc = func(lockName string) error {
+		return fmt.Errorf("%w %s: %w", lock.ErrLockTimeout, lockName, context.DeadlineExceeded)
+	}
+	ran := false
+	mocks := testSetup(t, nil, mockLocker, func(ctx context.Context, name string, args ...string) command.Command {
+		ran = true
+		return &command.MockCommand{}
+	})
+
+	args := []string{"--no-wait", "backup", "/mock/script.sh"}
+	err := run(context.Background(), args, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, mocks.Locker, mocks.CommandContext)
+
+	if !errors.Is(err, ErrJobSkipped) {
+		t.Fatalf("Expected the job to be skipped, got '%v'", err)
+	}
+	if code := ExitCode(err); code != exitSkipped {
+		t.Errorf("Expected exit code %d, got %d", exitSkipped, code)
+	}
+	if ran {
+		t.Errorf("Expected the job not to run")
+	}
+}
+
+func TestRun_MultipleGroupsRollBackOnTimeout(t *testing.T) {
+	var acquired, released []string
+	mockLocker := lock.NewMockLocker()
+	mockLocker.AcquireFunc = func(lockName string) error {
+		if lockName == "db" {
+			return fmt.Errorf("%w %s: %w", lock.ErrLockTimeout, lockName, context.DeadlineExceeded)
+		}
+		acquired = append(acquired, lockName)
+		return nil
+	}
+	mockLocker.ReleaseFunc = func(lockName string) error {
+		released = append(released, lockName)
+		return nil
+	}
+	mocks := testSetup(t, nil, mockLocker, nil)
+
+	args := []string{"network,db,backup", "/mock/script.sh"}
+	err := run(context.Background(), args, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, mocks.Locker, mocks.CommandContext)
+
+	if !errors.Is(err, lock.ErrLockTimeout) {
+		t.Fatalf("Expected a lock timeout, got '%v'", err)
+	}
+	if !reflect.DeepEqual(acquired, []string{"backup"}) {
+		t.Errorf("Expected only backup to be acquired before db, got %v", acquired)
+	}
+	if !reflect.DeepEqual(released, []string{"backup"}) {
+		t.Errorf("Expected backup to be released, got %v", released)
+	}
+}
+
+func TestParseArgs_Groups(t *testing.T) {
+	tests := []struct {
+		args   []string
+		groups []string
+		cmd    string
+	}{
+		{[]string{"backup", "/script.sh", "arg"}, []string{"backup"}, "/script.sh"},
+		{[]string{"network, db,backup", "/script.sh"}, []string{"backup", "db", "network"}, "/script.sh"},
+		{[]string{"--group", "network", "--group", "db,network", "/script.sh", "arg"}, []string{"db", "network"}, "/script.sh"},
+	}
+	for _, tt := range tests {
+		opts, err := parseArgs(tt.args, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs(%q): %v", tt.args, err)
+		}
+		if !reflect.DeepEqual(opts.groups, tt.groups) || opts.cmd != tt.cmd {
+			t.Errorf("parseArgs(%q) = groups %v, script %q; want %v, %q", tt.args, opts.groups, opts.cmd, tt.groups, tt.cmd)
+		}
+	}
+}
+
+func TestRun_MaxJobsTimeoutReleasesGroups(t *testing.T) {
+	mockLocker := lock.NewMockLocker()
+	mockLocker.AcquireJobSlotFunc = func() error {
+		return fmt.Errorf("%w job slot: %w", lock.ErrLockTimeout, context.DeadlineExceeded)
+	}
+	mocks := testSetup(t, configFileSystem(t, "max_jobs = 2\n"), mockLocker, nil)
+
+	err := run(context.Background(), []string{"backup", "/mock/script.sh"}, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, mocks.Locker, mocks.CommandContext)
+
+	if code := ExitCode(err); code != exitLockTimeout {
+		t.Fatalf("Expected exit code %d, got %d (%v)", exitLockTimeout, code, err)
+	}
+	// The group lock was released, so it can be taken again
+	if err := mockLocker.Acquire(context.Background(), "backup"); err != nil {
+		t.Errorf("Expected the group lock to be released, got %v", err)
+	}
+}
+
+func TestRun_NoWaitWaitsForJobSlot(t *testing.T) {
+	lockDir := t.TempDir()
+	lockFactory := func(cfg *config.Config, fs filesystem.FileSystem) (lock.Locker, error) {
+		c := *cfg
+		c.LockDir = lockDir
+		return lock.NewFileLocker(&c, filesystem.OSFileSystem{})
+	}
+	mocks := testSetup(t, configFileSystem(t, "max_jobs = 1\n"), nil, nil)
+
+	// Another job on the host holds the only slot for a while
+	otherCfg := config.DefaultConfig
+	otherCfg.MaxJobs = 1
+	other, _ := lockFactory(&otherCfg, nil)
+	if err := other.(lock.JobLimiter).AcquireJobSlot(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		other.(lock.JobLimiter).ReleaseJobSlot()
+	}()
+
+	// The group is free, so the job waits for the slot rather than being
+	// skipped
+	err := run(context.Background(), []string{"--no-wait", "backup", "/mock/script.sh"}, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, lockFactory, mocks.CommandContext)
+	if err != nil {
+		t.Fatalf("Expected the job to run once the slot was free, got %v", err)
+	}
+}
+
+func TestRun_Priority(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected int
+	}{
+		// The locker applies the group's priority itself
+		{"Group Default", []string{"db", "/mock/script.sh"}, 0},
+		{"Flag Overrides Group Default", []string{"--priority", "10", "db", "/mock/script.sh"}, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockLocker := lock.NewMockLocker()
+			mocks := testSetup(t, configFileSystem(t, "[groups.db]\npriority = 5\n"), mockLocker, nil)
+
+			if err := run(context.Background(), tt.args, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, mocks.Locker, mocks.CommandContext); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if mockLocker.Priority != tt.expected {
+				t.Errorf("Expected priority %d, got %d", tt.expected, mockLocker.Priority)
+			}
+		})
+	}
+}
+
+// exclusiveLocker is a lock backend that supports neither shared locks nor
+// priorities
+type exclusiveLocker struct {
+	lock.Locker
+}
+
+func TestRun_UnsupportedLockFeatures(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		args []string
+	}{
+		{"Shared", "", []string{"--shared", "db", "/mock/script.sh"}},
+		{"Priority Flag", "", []string{"--priority", "10", "db", "/mock/script.sh"}},
+		{"Group Priority", "[groups.db]\npriority = 5\n", []string{"db", "/mock/script.sh"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := false
+			mocks := testSetup(t, configFileSystem(t, tt.conf), nil, func(ctx context.Context, name string, args ...string) command.Command {
+				ran = true
+				return &command.MockCommand{}
+			})
+			lockFactory := func(cfg *config.Config, fs filesystem.FileSystem) (lock.Locker, error) {
+				return exclusiveLocker{lock.NewMockLocker()}, nil
+			}
+
+			err := run(context.Background(), tt.args, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, lockFactory, mocks.CommandContext)
+			if !errors.Is(err, ErrConfigInvalid) || ExitCode(err) != exitConfigInvalid {
+				t.Fatalf("Expected an invalid config error, got %v", err)
+			}
+			if ran {
+				t.Errorf("Expected the job not to run")
+			}
+		})
+	}
+
+	// Exclusive locks without priorities need neither
+	mocks := testSetup(t, nil, nil, nil)
+	lockFactory := func(cfg *config.Config, fs filesystem.FileSystem) (lock.Locker, error) {
+		return exclusiveLocker{lock.NewMockLocker()}, nil
+	}
+	if err := run(context.Background(), []string{"db", "/mock/script.sh"}, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, lockFactory, mocks.CommandContext); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
+
+func TestRun_MultipleGroups(t *testing.T) {
+	conf := `
+max_runtime = "1h"
+kill_grace = "30s"
+
+[groups.db]
+max_runtime = "10m"
+
+[groups.thumbs]
+max_concurrency = 4
+fair = true
+priority = 5
+max_runtime = "30m"
+kill_grace = "5s"
+on_locked = "fail"
+`
+	lockDir := t.TempDir()
+	var lockCfg config.Config
+	lockFactory := func(cfg *config.Config, fs filesystem.FileSystem) (lock.Locker, error) {
+		c := *cfg
+		c.LockDir = lockDir
+		lockCfg = c
+		return lock.NewFileLocker(&c, filesystem.OSFileSystem{})
+	}
+	cmd := &command.MockCommand{}
+	mocks := testSetup(t, configFileSystem(t, conf), nil, func(ctx context.Context, name string, args ...string) command.Command {
+		return cmd
+	})
+	args := []string{"--no-wait", "db,thumbs", "/mock/script.sh"}
+
+	// db has a single slot however many thumbs has, so a job holding it keeps
+	// the others out
+	holder, _ := lockFactory(&config.DefaultConfig, nil)
+	if err := holder.Acquire(context.Background(), "db"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	err := run(context.Background(), args, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, lockFactory, mocks.CommandContext)
+	if code := ExitCode(err); code != exitSkipped {
+		t.Fatalf("Expected exit code %d while db is held, got %d (%v)", exitSkipped, code, err)
+	}
+	if err := holder.Release("db"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := run(context.Background(), args, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, lockFactory, mocks.CommandContext); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The settings of each group's lock stay its own
+	if db := lockCfg.ForGroup("db"); db.MaxConcurrency > 1 || db.Fair || db.Priority != 0 {
+		t.Errorf("Expected db to keep the global lock settings, got max_concurrency %d, fair %t, priority %d", db.MaxConcurrency, db.Fair, db.Priority)
+	}
+	if thumbs := lockCfg.ForGroup("thumbs"); thumbs.MaxConcurrency != 4 || !thumbs.Fair || thumbs.Priority != 5 {
+		t.Errorf("Expected thumbs to keep its lock settings, got max_concurrency %d, fair %t, priority %d", thumbs.MaxConcurrency, thumbs.Fair, thumbs.Priority)
+	}
+	// The job gets the most restrictive of its groups' settings
+	if cmd.MaxRuntime != 10*time.Minute || cmd.KillGrace != 5*time.Second {
+		t.Errorf("Expected a max runtime of 10m and kill grace of 5s, got %s and %s", cmd.MaxRuntime, cmd.KillGrace)
+	}
+}
+
+func TestConfig_ForGroups(t *testing.T) {
+	cfg, err := config.LoadConfig(configFileSystem(t, `
+[groups.backup]
+on_locked = "skip"
+kill_process_group = false
+
+[groups.db]
+orphan_policy = "wait"
+[groups.db.retry]
+max_attempts = 3
+
+[groups.sync]
+on_locked = "fail"
+[groups.sync.retry]
+max_attempts = 5
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	tests := []struct {
+		groups      []string
+		onLocked    string
+		orphans     string
+		maxAttempts int
+	}{
+		{[]string{"backup"}, "skip", "ignore", 0},
+		{[]string{"backup", "db"}, "skip", "wait", 0},
+		{[]string{"db", "sync"}, "fail", "kill", 3},
+		{[]string{"backup", "sync"}, "fail", "kill", 0},
+	}
+	for _, tt := range tests {
+		merged := cfg.ForGroups(tt.groups)
+		if merged.OnLocked != tt.onLocked || merged.OrphanPolicy != tt.orphans || merged.Retry.MaxAttempts != tt.maxAttempts {
+			t.Errorf("ForGroups(%q): expected on_locked %s, orphan_policy %s and %d attempts, got %s, %s and %d",
+				tt.groups, tt.onLocked, tt.orphans, tt.maxAttempts, merged.OnLocked, merged.OrphanPolicy, merged.Retry.MaxAttempts)
+		}
+	}
+}
+
+func TestRenderLockKey(t *testing.T) {
+	env := map[string]string{"TENANT": "acme"}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	args := []string{"customer42", "--full"}
+
+	tests := []struct {
+		template string
+		expected string
+		err      bool
+	}{
+		{"sync", "sync", false},
+		{"sync-{arg1}", "sync-customer42", false},
+		{"{env:TENANT}/sync-{arg1}{arg2}", "acme/sync-customer42--full", false},
+		{"sync-{arg3}", "", true},
+		{"sync-{env:MISSING}", "", true},
+		{"sync-{user}", "", true},
+		{"sync-{arg1", "", true},
+	}
+	for _, tt := range tests {
+		key, err := renderLockKey(tt.template, args, lookupEnv)
+		if (err != nil) != tt.err || key != tt.expected {
+			t.Errorf("renderLockKey(%q) = %q, %v; want %q, error %v", tt.template, key, err, tt.expected, tt.err)
+		}
+	}
+
+	// The hash tells apart argument lists that join to the same string
+	first, _ := renderLockKey("{args_hash}", []string{"a b"}, lookupEnv)
+	second, _ := renderLockKey("{args_hash}", []string{"a", "b"}, lookupEnv)
+	if first == second || len(first) != 12 {
+		t.Errorf("expected distinct 12 character hashes, got %q and %q", first, second)
+	}
+}
+
+func TestRun_LockKeyTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     string
+		args     []string
+		expected []string
+		code     int
+	}{
+		{"Group Spec", "", []string{"sync-{arg1}", "/mock/sync.sh", "customer42"}, []string{"sync-customer42"}, 0},
+		{"Configured Lock Key", "[groups.sync]\nlock_key = \"sync/{arg1}\"\n", []string{"sync", "/mock/sync.sh", "customer42"}, []string{"sync/customer42"}, 0},
+		{"Argument Escapes Lock Directory", "", []string{"sync-{arg1}", "/mock/sync.sh", "/../x"}, nil, exitUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var acquired []string
+			mockLocker := lock.NewMockLocker()
+			mockLocker.AcquireFunc = func(lockName string) error {
+				acquired = append(acquired, lockName)
+				return nil
+			}
+			mockLocker.ReleaseFunc = func(lockName string) error { return nil }
+			mocks := testSetup(t, configFileSystem(t, tt.conf), mockLocker, nil)
+
+			err := run(context.Background(), tt.args, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, mocks.Locker, mocks.CommandContext)
+			if code := ExitCode(err); code != tt.code {
+				t.Fatalf("Expected exit code %d, got %d (%v)", tt.code, code, err)
+			}
+			if !reflect.DeepEqual(acquired, tt.expected) {
+				t.Errorf("Expected locks %v, got %v", tt.expected, acquired)
+			}
+		})
+	}
+}
+
+func TestRun_StaleHolder(t *testing.T) {
+	stale := lock.Holder{
+		PID:      4242,
+		PGID:     4242,
+		Hostname: "elsewhere",
+		Command:  []string{"/mock/other.sh", "--full"},
+		RunID:    "0123456789abcdef",
+		Started:  time.Now().Add(-2 * time.Hour),
+		Acquired: time.Now().Add(-time.Hour),
+	}
+	// The groups are checked in order, so once db is checked the stale
+	// holder of backup has been dealt with
+	checked := make(chan struct{})
+	var once sync.Once
+	mockLocker := lock.NewMockLocker()
+	mockLocker.HoldersFunc = func(lockName string) ([]lock.Holder, error) {
+		if lockName == "db" {
+			once.Do(func() { close(checked) })
+			return nil, nil
+		}
+		return []lock.Holder{stale}, nil
+	}
+	mockLocker.AcquireFunc = func(lockName string) error {
+		<-checked
+		return nil
+	}
+	mockLocker.ReleaseFunc = func(lockName string) error { return nil }
+
+	// History is kept in the mock's files
+	fs := configFileSystem(t, "stale_after = \"30m\"\nstale_action = \"term\"\n")
+	fs.OpenFileFunc = nil
+	fs.Files = make(map[string]*string)
+	mocks := testSetup(t, fs, mockLocker, nil)
+
+	stderr := &bytes.Buffer{}
+	if err := run(context.Background(), []string{"backup,db", "/mock/script.sh"}, &bytes.Buffer{}, stderr, mocks.FileSystem, mocks.Locker, mocks.CommandContext); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !strings.Contains(stderr.String(), "Stale lock holder: run 0123456789abcdef") || !strings.Contains(stderr.String(), "runs on another host") {
+		t.Errorf("Expected the stale holder to be logged without being signaled, got %q", stderr.String())
+	}
+	var waiter, holder string
+	for name, content := range fs.Files {
+		switch {
+		case strings.HasSuffix(name, "script.sh.log"):
+			waiter = *content
+		case strings.HasSuffix(name, "other.sh.log"):
+			holder = *content
+		}
+	}
+	if !strings.Contains(waiter, `"stale_holders":["run 0123456789abcdef held group 'backup'`) {
+		t.Errorf("Expected the waiter's history to record the stale holder, got %q", waiter)
+	}
+	if !strings.Contains(holder, `"run_id":"0123456789abcdef"`) || !strings.Contains(holder, `"status":"stale"`) {
+		t.Errorf("Expected the holder's history to record it as stale, got %q", holder)
+	}
+}
+
+func TestRun_RecordsJobProcessGroup(t *testing.T) {
+	mockLocker := lock.NewMockLocker()
+	mocks := testSetup(t, nil, mockLocker, func(ctx context.Context, name string, args ...string) command.Command {
+		return &command.MockCommand{PGID: 4242}
+	})
+
+	if err := run(context.Background(), []string{"backup", "/mock/script.sh"}, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, mocks.Locker, mocks.CommandContext); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	updated := mockLocker.UpdatedHolder
+	if updated == nil || updated.PGID != 4242 || updated.RunID != mockLocker.Holder.RunID {
+		t.Errorf("Expected the job's process group to be recorded for its run, got %+v", updated)
+	}
+}
+
+func TestRun_LockLostCancelsJob(t *testing.T) {
+	mockLocker := lock.NewMockLocker()
+	mockLocker.LostCh = make(chan struct{})
+	mocks := testSetup(t, nil, mockLocker, func(ctx context.Context, name string, args ...string) command.Command {
+		return &command.MockCommand{
+			ExitSignal: syscall.SIGTERM,
+			RunFunc: func() error {
+				close(mockLocker.LostCh)
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		}
+	})
+
+	err := run(context.Background(), []string{"backup", "/mock/script.sh"}, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, mocks.Locker, mocks.CommandContext)
+
+	if !errors.Is(err, ErrLockLost) {
+		t.Fatalf("Expected the job to be canceled as its lock was lost, got %v", err)
+	}
+	if code := ExitCode(err); code != 128+int(syscall.SIGTERM) {
+		t.Errorf("Expected exit code %d, got %d", 128+int(syscall.SIGTERM), code)
+	}
+}
+
+func TestRun_LockTimeoutRecordsHolder(t *testing.T) {
+	mockLocker := lock.NewMockLocker()
+	mockLocker.AcquireFunc = func(lockName string) error {
+		return fmt.Errorf("%w %s: %w", lock.ErrLockTimeout, lockName, context.DeadlineExceeded)
+	}
+	mockLocker.HoldersFunc = func(lockName string) ([]lock.Holder, error) {
+		return []lock.Holder{{PID: 4242, Hostname: "node2", RunID: "0123456789abcdef"}}, nil
+	}
+	fs := configFileSystem(t, "on_locked = \"skip\"\n")
+	fs.OpenFileFunc = nil
+	fs.Files = make(map[string]*string)
+	mocks := testSetup(t, fs, mockLocker, nil)
+
+	err := run(context.Background(), []string{"backup", "/mock/script.sh"}, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, mocks.Locker, mocks.CommandContext)
+
+	if code := ExitCode(err); code != exitSkipped {
+		t.Fatalf("Expected exit code %d, got %d (%v)", exitSkipped, code, err)
+	}
+	var entry string
+	for name, content := range fs.Files {
+		if strings.HasSuffix(name, "script.sh.log") {
+			entry = *content
+		}
+	}
+	if !strings.Contains(entry, `"held_by":["run 0123456789abcdef (pid 4242 on node2)"]`) {
+		t.Errorf("Expected the history to record the holder, got %q", entry)
+	}
+}
+
+func TestRun_OrphanPolicyFollowsProcessGroup(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     string
+		expected command.OrphanPolicy
+	}{
+		{"Default", "", command.OrphanKill},
+		{"Daemonizing Job", "kill_process_group = false\n", command.OrphanIgnore},
+		{"Explicit Policy", "kill_process_group = false\norphan_policy = \"wait\"\n", command.OrphanWait},
+		{"Daemonizing Group", "[groups.backup]\nkill_process_group = false\n", command.OrphanIgnore},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := &command.MockCommand{}
+			mocks := testSetup(t, configFileSystem(t, tt.conf), nil, func(ctx context.Context, name string, args ...string) command.Command {
+				return cmd
+			})
+			if err := run(context.Background(), []string{"backup", "/mock/script.sh"}, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, mocks.Locker, mocks.CommandContext); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if cmd.OrphanPolicy != tt.expected {
+				t.Errorf("Expected orphan policy %q, got %q", tt.expected, cmd.OrphanPolicy)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// EtcdLocker implements the Locker interface with etcd mutexes, for jobs
+// that must run on exactly one node of a cluster.
+//
+// The locks of a job are held through a single session, whose lease is kept
+// alive while the job runs and expires session_ttl after the job loses touch
+// with the cluster, releasing its locks to the next node. Waiting nodes
+// acquire a lock in the order they asked for it. Along with the mutex the
+// holder is recorded under a key bound to the session, so that the other
+// nodes can tell which node won.
+//
+// Locks are always exclusive and groups are locked independently of their
+// subgroups. Priorities are not honoured.
+type EtcdLocker struct {
+	cfg      *config.Config
+	settings EtcdConfig
+	client   *clientv3.Client
+	session  *concurrency.Session // nil while no lock is held
+	locks    map[string]*concurrency.Mutex
+	holder   *Holder
+}
+
+// EtcdConfig configures the etcd lock backend. It is read from the etcd table
+// of the configuration.
+type EtcdConfig struct {
+	Endpoints []string `toml:"endpoints"`
+	Username  string   `toml:"username"`
+	Password  string   `toml:"password"`
+	// KeyPrefix is prepended to the keys of the locks, so that several
+	// deployments can share a cluster.
+	KeyPrefix string `toml:"key_prefix"`
+	// SessionTTL is how long the locks of a job survive once it loses touch
+	// with the cluster. It is rounded down to whole seconds.
+	SessionTTL config.Duration `toml:"session_ttl"`
+	// DialTimeout bounds connecting to the cluster, and each request made
+	// other than while waiting for a lock.
+	DialTimeout config.Duration `toml:"dial_timeout"`
+}
+
+// DefaultEtcdConfig holds the settings of the etcd backend that the
+// configuration does not set.
+var DefaultEtcdConfig = EtcdConfig{
+	Endpoints:   []string{"localhost:2379"},
+	KeyPrefix:   "/jobwrapper/",
+	SessionTTL:  config.Duration(30 * time.Second),
+	DialTimeout: config.Duration(5 * time.Second),
+}
+
+// NewEtcdLocker creates a new EtcdLocker for the cluster in the etcd
+// configuration
+func NewEtcdLocker(cfg *config.Config, fs filesystem.FileSystem) (Locker, error) {
+	settings := DefaultEtcdConfig
+	// Decoding may reuse the backing array of the default endpoints
+	settings.Endpoints = slices.Clone(DefaultEtcdConfig.Endpoints)
+	if err := cfg.Section("etcd", &settings); err != nil {
+		return nil, err
+	}
+	if len(settings.Endpoints) == 0 {
+		return nil, fmt.Errorf("%w: etcd.endpoints: must be set", config.ErrConfigInvalid)
+	}
+	if settings.SessionTTL < config.Duration(time.Second) {
+		return nil, fmt.Errorf("%w: etcd.session_ttl: must be at least 1s", config.ErrConfigInvalid)
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   settings.Endpoints,
+		Username:    settings.Username,
+		Password:    settings.Password,
+		DialTimeout: time.Duration(settings.DialTimeout),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to etcd: %w", err)
+	}
+	return &EtcdLocker{
+		cfg:      cfg,
+		settings: settings,
+		client:   client,
+		locks:    make(map[string]*concurrency.Mutex),
+	}, nil
+}
+
+// mutexPrefix returns the prefix of a group's mutex. The group is escaped so
+// that the mutex of a group does not take in those of its subgroups
+func (el *EtcdLocker) mutexPrefix(lockName string) string {
+	return el.settings.KeyPrefix + "lock/" + url.QueryEscape(lockName)
+}
+
+// holderKey returns the key the holder of a group is recorded under
+func (el *EtcdLocker) holderKey(lockName string) string {
+	return el.settings.KeyPrefix + "holder/" + url.QueryEscape(lockName)
+}
+
+// requestContext returns a context bounding a single request to the cluster
+func (el *EtcdLocker) requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Duration(el.settings.DialTimeout))
+}
+
+// startSession returns the session locks are held through, starting a new
+// one if none is held
+func (el *EtcdLocker) startSession() (*concurrency.Session, error) {
+	if el.session != nil {
+		return el.session, nil
+	}
+	// The lease is granted separately, as a session started with a context
+	// would end with it
+	ttl := int(time.Duration(el.settings.SessionTTL) / time.Second)
+	ctx, cancel := el.requestContext()
+	defer cancel()
+	lease, err := el.client.Grant(ctx, int64(ttl))
+	if err != nil {
+		return nil, fmt.Errorf("error starting etcd session: %w", err)
+	}
+	session, err := concurrency.NewSession(el.client, concurrency.WithLease(lease.ID), concurrency.WithTTL(ttl))
+	if err != nil {
+		return nil, fmt.Errorf("error starting etcd session: %w", err)
+	}
+	el.session = session
+	return session, nil
+}
+
+// Acquire locks the group's mutex, waiting behind the nodes that asked for
+// it first until ctx is done, and records the holder
+func (el *EtcdLocker) Acquire(ctx context.Context, lockName string) error {
+	if err := ValidateGroup(lockName); err != nil {
+		return err
+	}
+	if el.cfg.ForGroup(lockName).MaxConcurrency > 1 {
+		return fmt.Errorf("lock %s allows several concurrent jobs, which the etcd backend does not support", lockName)
+	}
+	if _, ok := el.locks[lockName]; ok {
+		return fmt.Errorf("lock %s is already held", lockName)
+	}
+
+	session, err := el.startSession()
+	if err != nil {
+		return err
+	}
+	mutex := concurrency.NewMutex(session, el.mutexPrefix(lockName))
+	if err := el.lockMutex(ctx, session, mutex); err != nil {
+		_ = el.endSession()
+		if ctx.Err() != nil {
+			return contextError(ctx, lockName)
+		}
+		return fmt.Errorf("failed to acquire lock %s: %w", lockName, err)
+	}
+
+	if el.holder != nil {
+		holder := *el.holder
+		holder.Acquired = time.Now()
+		if err := el.recordHolder(session, mutex, lockName, holder); err != nil {
+			_, _ = el.unlockMutex(lockName, mutex)
+			_ = el.endSession()
+			return fmt.Errorf("failed to acquire lock %s: %w", lockName, err)
+		}
+	}
+	el.locks[lockName] = mutex
+	return nil
+}
+
+// lockMutex tries the mutex once, then waits for it until ctx is done or the
+// session is lost
+func (el *EtcdLocker) lockMutex(ctx context.Context, session *concurrency.Session, mutex *concurrency.Mutex) error {
+	tryCtx, cancel := el.requestContext()
+	err := mutex.TryLock(tryCtx)
+	cancel()
+	if !errors.Is(err, concurrency.ErrLocked) || ctx.Err() != nil {
+		return err
+	}
+
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-session.Done():
+			cancel()
+		case <-waitCtx.Done():
+		}
+	}()
+	if err := mutex.Lock(waitCtx); err != nil {
+		if ctx.Err() == nil && waitCtx.Err() != nil {
+			return concurrency.ErrSessionExpired
+		}
+		return err
+	}
+	return nil
+}
+
+// recordHolder records the holder of a group under a key bound to the
+// session, provided the mutex is still held
+func (el *EtcdLocker) recordHolder(session *concurrency.Session, mutex *concurrency.Mutex, lockName string, holder Holder) error {
+	data, err := json.Marshal(holder)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := el.requestContext()
+	defer cancel()
+	resp, err := el.client.Txn(ctx).
+		If(mutex.IsOwner()).
+		Then(clientv3.OpPut(el.holderKey(lockName), string(data), clientv3.WithLease(session.Lease()))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return concurrency.ErrSessionExpired
+	}
+	return nil
+}
+
+// unlockMutex removes the holder record and unlocks the mutex, and reports
+// whether the mutex was still held
+func (el *EtcdLocker) unlockMutex(lockName string, mutex *concurrency.Mutex) (bool, error) {
+	ctx, cancel := el.requestContext()
+	defer cancel()
+	resp, err := el.client.Txn(ctx).
+		If(mutex.IsOwner()).
+		Then(clientv3.OpDelete(el.holderKey(lockName)), clientv3.OpDelete(mutex.Key())).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// endSession ends the session once no lock is held through it, which
+// releases anything left bound to it
+func (el *EtcdLocker) endSession() error {
+	if el.session == nil || len(el.locks) > 0 {
+		return nil
+	}
+	session := el.session
+	el.session = nil
+	select {
+	case <-session.Done():
+		// Already expired, so there is nothing to revoke
+		return nil
+	default:
+	}
+	return session.Close()
+}
+
+// Release unlocks the group's mutex, and ends the session once no other lock
+// is held. If the session expired while the lock was held, ErrLeaseLost is
+// returned
+func (el *EtcdLocker) Release(lockName string) error {
+	mutex, ok := el.locks[lockName]
+	if !ok {
+		return fmt.Errorf("lock %s is not held", lockName)
+	}
+	delete(el.locks, lockName)
+
+	held, err := el.unlockMutex(lockName, mutex)
+	err = errors.Join(err, el.endSession())
+	if err != nil {
+		return fmt.Errorf("failed to release lock %s: %w", lockName, err)
+	}
+	if !held {
+		return fmt.Errorf("%w for %s: etcd session expired", ErrLeaseLost, lockName)
+	}
+	return nil
+}
+
+// Lost returns a channel that is closed if the session the locks are held
+// through expires. It never closes while no lock is held
+func (el *EtcdLocker) Lost() <-chan struct{} {
+	if el.session == nil {
+		return nil
+	}
+	return el.session.Done()
+}
+
+// Close closes the connection to the cluster. Locks still held are left to
+// expire with the session
+func (el *EtcdLocker) Close() error {
+	return el.client.Close()
+}
+
+// SetHolder sets the metadata recorded for locks acquired after the call
+func (el *EtcdLocker) SetHolder(holder Holder) {
+	el.holder = &holder
+}
+
+// UpdateHolder records the holder anew for each lock held, and sets it for
+// locks acquired after the call
+func (el *EtcdLocker) UpdateHolder(holder Holder) error {
+	el.holder = &holder
+	var errs []error
+	for lockName, mutex := range el.locks {
+		recorded, err := el.Holders(lockName)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var previous *Holder
+		if len(recorded) > 0 {
+			previous = &recorded[0]
+		}
+		if err := el.recordHolder(el.session, mutex, lockName, updatedHolder(holder, previous)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to update the holder of lock %s: %w", lockName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// List reports every held lock whose holder is recorded. Free locks have no
+// keys, so they are not listed
+func (el *EtcdLocker) List() ([]LockInfo, error) {
+	ctx, cancel := el.requestContext()
+	defer cancel()
+	prefix := el.holderKey("")
+	resp, err := el.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("error listing locks: %w", err)
+	}
+
+	locks := make([]LockInfo, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		group, err := url.QueryUnescape(strings.TrimPrefix(string(kv.Key), prefix))
+		if err != nil {
+			continue
+		}
+		info := LockInfo{Group: group, Held: true, Mode: ModeExclusive}
+		var holder Holder
+		if json.Unmarshal(kv.Value, &holder) == nil {
+			info.Holder = &holder
+		}
+		locks = append(locks, info)
+	}
+	return locks, nil
+}
+
+// Holders returns the recorded holder of the group, unless it is free
+func (el *EtcdLocker) Holders(lockName string) ([]Holder, error) {
+	ctx, cancel := el.requestContext()
+	defer cancel()
+	resp, err := el.client.Get(ctx, el.holderKey(lockName))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	var holder Holder
+	if err := json.Unmarshal(resp.Kvs[0].Value, &holder); err != nil {
+		return nil, fmt.Errorf("invalid lock holder in %s: %w", el.holderKey(lockName), err)
+	}
+	return []Holder{holder}, nil
+}
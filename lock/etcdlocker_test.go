@@ -0,0 +1,150 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// startTestEtcd starts an embedded single node etcd server and returns its
+// client URL
+func startTestEtcd(t *testing.T) string {
+	t.Helper()
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL, peerURL := freeURL(t), freeURL(t)
+	cfg.ListenClientUrls = []url.URL{clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{clientURL}
+	cfg.ListenPeerUrls = []url.URL{peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("failed to start etcd: %v", err)
+	}
+	t.Cleanup(server.Close)
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("etcd did not become ready")
+	}
+	return clientURL.String()
+}
+
+// freeURL returns a local URL on a port that is free
+func freeURL(t *testing.T) url.URL {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer listener.Close()
+	return url.URL{Scheme: "http", Host: listener.Addr().String()}
+}
+
+func newTestEtcdLocker(t *testing.T, endpoint string) *EtcdLocker {
+	t.Helper()
+	cfg := &config.Config{
+		LockBackend: "etcd",
+	}
+	if err := cfg.SetSection("etcd", EtcdConfig{
+		Endpoints:   []string{endpoint},
+		KeyPrefix:   "/jobwrapper/",
+		SessionTTL:  config.Duration(5 * time.Second),
+		DialTimeout: config.Duration(5 * time.Second),
+	}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	locker, err := NewLocker(cfg, filesystem.OSFileSystem{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	t.Cleanup(func() { locker.(*EtcdLocker).Close() })
+	return locker.(*EtcdLocker)
+}
+
+func TestEtcdLocker(t *testing.T) {
+	endpoint := startTestEtcd(t)
+
+	t.Run("Exclusive", func(t *testing.T) {
+		first := newTestEtcdLocker(t, endpoint)
+		second := newTestEtcdLocker(t, endpoint)
+		first.SetHolder(Holder{RunID: "run1", Hostname: "node1"})
+
+		if err := first.Acquire(context.Background(), "db"); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		// A subgroup is locked independently
+		if err := second.Acquire(context.Background(), "db/backup"); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := second.Acquire(ctx, "db"); !errors.Is(err, ErrLockTimeout) {
+			t.Fatalf("expected a lock timeout, got %v", err)
+		}
+
+		holders, err := second.Holders("db")
+		if err != nil || len(holders) != 1 || holders[0].Hostname != "node1" {
+			t.Errorf("expected node1 to hold the lock, got %v, %v", holders, err)
+		}
+		locks, err := second.List()
+		if err != nil || len(locks) != 1 || locks[0].Group != "db" {
+			t.Errorf("expected db to be listed, got %+v, %v", locks, err)
+		}
+
+		// A waiter gets the lock as soon as it is released
+		acquired := make(chan error)
+		go func() { acquired <- second.Acquire(context.Background(), "db") }()
+		time.Sleep(100 * time.Millisecond)
+		if err := first.Release("db"); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if err := <-acquired; err != nil {
+			t.Fatalf("expected the released lock to be taken, got %v", err)
+		}
+		for _, group := range []string{"db", "db/backup"} {
+			if err := second.Release(group); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+	})
+
+	t.Run("Session Lost", func(t *testing.T) {
+		first := newTestEtcdLocker(t, endpoint)
+		second := newTestEtcdLocker(t, endpoint)
+
+		if err := first.Acquire(context.Background(), "backup"); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		lost := first.Lost()
+		// Revoking the lease is what happens once it expires
+		if _, err := first.client.Revoke(context.Background(), first.session.Lease()); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		select {
+		case <-lost:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("expected the lost session to be reported")
+		}
+
+		if err := second.Acquire(context.Background(), "backup"); err != nil {
+			t.Fatalf("expected the lock to be free, got %v", err)
+		}
+		if err := first.Release("backup"); !errors.Is(err, ErrLeaseLost) {
+			t.Errorf("expected the lock to be lost, got %v", err)
+		}
+		if err := second.Release("backup"); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	})
+}
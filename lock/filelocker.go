@@ -0,0 +1,600 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+)
+
+// FileLocker implements the Locker interface using lock files
+type FileLocker struct {
+	cfg       *config.Config
+	fs        filesystem.FileSystem
+	fileLocks map[string]*flock.Flock // keyed by lock file path
+	acquired  map[string]*heldLock    // keyed by lock name
+	intents   map[string]int          // intent locks held, counted by lock name
+	jobSlot   *flock.Flock
+	holder    *Holder
+	mode      Mode
+	priority  *int // overrides the groups' configured priority when set
+}
+
+// heldLock is a group lock held by a FileLocker
+type heldLock struct {
+	fileLock *flock.Flock
+	// intents are the groups whose intent locks were taken along with the
+	// lock, in the order they were taken
+	intents []string
+	// holder is the holder recorded in the lock file, if any
+	holder *Holder
+}
+
+// NewFileLocker creates a new FileLocker with the given base path for lock files
+func NewFileLocker(cfg *config.Config, fs filesystem.FileSystem) (Locker, error) {
+	return &FileLocker{
+		cfg:       cfg,
+		fs:        fs,
+		fileLocks: make(map[string]*flock.Flock),
+		acquired:  make(map[string]*heldLock),
+		intents:   make(map[string]int),
+	}, nil
+}
+
+func (fl *FileLocker) lockFilename(lockname string) string {
+	// The lock file path is constructed by joining the lock directory, lock name, and lock file name
+	return filepath.Join(fl.cfg.LockDir, lockname, fl.cfg.LockFileName)
+}
+
+// slotFilename returns the path of one of the numbered lock files of a group
+// that allows several concurrent jobs
+func (fl *FileLocker) slotFilename(lockName string, slot int) string {
+	return fmt.Sprintf("%s.%d", fl.lockFilename(lockName), slot)
+}
+
+// lockFilenames returns the lock files of a group in the order they are
+// tried. A group with a max_concurrency above one has a slot file for each
+// job that may hold it at once, and holding any one of them holds the group
+func (fl *FileLocker) lockFilenames(lockName string) []string {
+	slots := fl.cfg.ForGroup(lockName).MaxConcurrency
+	if slots <= 1 {
+		return []string{fl.lockFilename(lockName)}
+	}
+	filenames := make([]string, slots)
+	for i := range filenames {
+		filenames[i] = fl.slotFilename(lockName, i+1)
+	}
+	return filenames
+}
+
+// turnstileFilename returns the path of the lock file exclusive holders take
+// while waiting for a group, which stops new shared holders from starving them
+func (fl *FileLocker) turnstileFilename(lockName string) string {
+	return fl.lockFilename(lockName) + ".writer"
+}
+
+// jobSlotFilename returns the path of one of the lock files that limit how
+// many jobs run at once on the host
+func (fl *FileLocker) jobSlotFilename(slot int) string {
+	return filepath.Join(fl.cfg.LockDir, fmt.Sprintf("%s.job.%d", fl.cfg.LockFileName, slot))
+}
+
+// intentFilename returns the path of the lock file that jobs in the group's
+// subgroups lock shared, and exclusive holders of the group lock exclusively
+func (fl *FileLocker) intentFilename(lockName string) string {
+	return fl.lockFilename(lockName) + ".intent"
+}
+
+// readersFilename returns the path of the lock file that shared holders of
+// the group keep locked shared. Exclusive jobs in its subgroups lock it
+// exclusively on their way in, so they wait for the shared holders
+func (fl *FileLocker) readersFilename(lockName string) string {
+	return fl.lockFilename(lockName) + ".readers"
+}
+
+// writersFilename returns the path of the lock file that exclusive jobs in the
+// group's subgroups keep locked shared. Shared holders of the group lock it
+// exclusively on their way in, so they wait for those jobs
+func (fl *FileLocker) writersFilename(lockName string) string {
+	return fl.lockFilename(lockName) + ".writers"
+}
+
+// fileLock returns the cached flock for a lock file
+func (fl *FileLocker) fileLock(filename string) *flock.Flock {
+	fileLock, ok := fl.fileLocks[filename]
+	if !ok {
+		fileLock = flock.New(filename)
+		fl.fileLocks[filename] = fileLock
+	}
+	return fileLock
+}
+
+// Acquire locks the group's lock file, or the first free slot file if the
+// group allows several concurrent jobs, and records the holder in it.
+//
+// In shared mode the lock file is locked shared, so other shared holders may
+// hold the group at the same time. Exclusive holders have preference: while
+// one is waiting for the group no new shared holders are let in.
+//
+// Groups nest by their slash separated names. A job in "db/backup" first
+// takes a shared intent lock on "db", and an exclusive holder of "db" also
+// locks its intent file exclusively, so it excludes every job in its
+// subgroups while they do not exclude each other. A shared holder of "db"
+// likewise excludes exclusive jobs in its subgroups, but not shared ones.
+//
+// A job that finds the group locked queues for it behind those with a higher
+// priority or that arrived earlier, and only the job at the front of the
+// queue tries for the group. In a fair group every job queues, even if the
+// group is free.
+func (fl *FileLocker) Acquire(ctx context.Context, lockName string) error {
+	if err := ValidateGroup(lockName); err != nil {
+		return err
+	}
+	var (
+		groupLockDir = filepath.Join(fl.cfg.LockDir, lockName)
+		filenames    = fl.lockFilenames(lockName)
+	)
+	if fl.mode == ModeShared && len(filenames) > 1 {
+		return fmt.Errorf("lock %s allows several concurrent jobs and cannot be held shared", lockName)
+	}
+
+	// Ensure lock directory exists
+	if err := fl.fs.MkdirAll(groupLockDir, 0755); err != nil {
+		return fmt.Errorf("error creating lock directory for group '%s': %w", lockName, err)
+	}
+
+	held := &heldLock{}
+	for _, parent := range parentGroups(lockName) {
+		if err := fl.acquireIntent(ctx, parent); err != nil {
+			fl.releaseIntents(held.intents)
+			return err
+		}
+		held.intents = append(held.intents, parent)
+	}
+
+	slot, err := fl.lockQueued(ctx, lockName, filenames)
+	if err != nil {
+		fl.releaseIntents(held.intents)
+		return err
+	}
+	if fl.holdsIntent(filenames) {
+		held.intents = append(held.intents, lockName)
+	}
+	held.fileLock = fl.fileLock(filenames[slot])
+	fl.acquired[lockName] = held
+
+	// Several shared holders can hold the lock file at once, so only
+	// exclusive holders are recorded in it
+	if fl.holder != nil && fl.mode != ModeShared {
+		holder := *fl.holder
+		holder.Acquired = time.Now()
+		if len(filenames) > 1 {
+			holder.Slot = slot + 1
+		}
+		// The metadata is informational, and cannot be written where file
+		// locks are mandatory such as on Windows, so failures are ignored
+		_ = writeHolder(fl.fs, held.fileLock.Path(), &holder)
+		held.holder = &holder
+	}
+
+	return nil
+}
+
+// lockFiles takes the group's own lock files in the locker's mode, and
+// returns the slot it locked
+func (fl *FileLocker) lockFiles(ctx context.Context, lockName string, filenames []string) (int, error) {
+	switch {
+	case len(filenames) > 1:
+		return fl.lockAny(ctx, lockName, filenames, false)
+	case fl.mode == ModeShared:
+		return 0, fl.lockReader(ctx, lockName, filenames[0])
+	}
+	return 0, fl.lockExclusive(ctx, lockName)
+}
+
+// unlockFiles releases the lock files taken by lockFiles
+func (fl *FileLocker) unlockFiles(lockName string, filenames []string, slot int) error {
+	err := fl.fileLock(filenames[slot]).Unlock()
+	if fl.holdsIntent(filenames) {
+		err = errors.Join(err, fl.releaseIntents([]string{lockName}))
+	}
+	if fl.mode == ModeShared {
+		err = errors.Join(err, fl.fileLock(fl.readersFilename(lockName)).Unlock())
+	}
+	return err
+}
+
+// lockReader locks the group's lock file shared, and keeps exclusive jobs in
+// its subgroups out: it locks the readers file shared, so no more of them
+// come in, and waits for those already in to leave the writers file
+func (fl *FileLocker) lockReader(ctx context.Context, lockName, filename string) error {
+	if err := fl.lockShared(ctx, lockName, filename); err != nil {
+		return err
+	}
+	readers := fl.readersFilename(lockName)
+	if err := fl.lockOne(ctx, lockName, readers, true); err != nil {
+		_ = fl.fileLock(filename).Unlock()
+		return err
+	}
+	writers := fl.writersFilename(lockName)
+	if err := fl.lockOne(ctx, lockName, writers, false); err != nil {
+		_ = fl.fileLock(readers).Unlock()
+		_ = fl.fileLock(filename).Unlock()
+		return err
+	}
+	return fl.fileLock(writers).Unlock()
+}
+
+// holdsIntent reports whether lockFiles also locks the group's own intent
+// file, which only exclusive holders of a single lock file do
+func (fl *FileLocker) holdsIntent(filenames []string) bool {
+	return len(filenames) == 1 && fl.mode != ModeShared
+}
+
+// lockExclusive locks the group's lock file and intent file exclusively. The
+// turnstile is held while waiting so that shared holders and subgroup jobs
+// arriving later queue behind us
+func (fl *FileLocker) lockExclusive(ctx context.Context, lockName string) error {
+	if fl.intents[lockName] > 0 {
+		return fmt.Errorf("lock %s cannot be held exclusively while holding one of its subgroups", lockName)
+	}
+
+	turnstile := fl.turnstileFilename(lockName)
+	if err := fl.lockOne(ctx, lockName, turnstile, false); err != nil {
+		return err
+	}
+	defer fl.fileLock(turnstile).Unlock()
+
+	if err := fl.lockOne(ctx, lockName, fl.lockFilename(lockName), false); err != nil {
+		return err
+	}
+	if err := fl.lockOne(ctx, lockName, fl.intentFilename(lockName), false); err != nil {
+		_ = fl.fileLock(fl.lockFilename(lockName)).Unlock()
+		return err
+	}
+	fl.intents[lockName]++
+	return nil
+}
+
+// lockShared locks one of the group's files shared, which is only allowed
+// once no exclusive holder is waiting at the turnstile
+func (fl *FileLocker) lockShared(ctx context.Context, lockName, filename string) error {
+	turnstile := fl.turnstileFilename(lockName)
+	if err := fl.lockOne(ctx, lockName, turnstile, true); err != nil {
+		return err
+	}
+	defer fl.fileLock(turnstile).Unlock()
+
+	return fl.lockOne(ctx, lockName, filename, true)
+}
+
+// acquireIntent takes a shared intent lock on a parent group, unless this
+// locker already holds its intent file. An exclusive job also waits for the
+// parent's shared holders, by passing through its readers file, and then
+// locks its writers file shared
+func (fl *FileLocker) acquireIntent(ctx context.Context, lockName string) error {
+	if fl.intents[lockName] == 0 {
+		if err := fl.fs.MkdirAll(filepath.Join(fl.cfg.LockDir, lockName), 0755); err != nil {
+			return fmt.Errorf("error creating lock directory for group '%s': %w", lockName, err)
+		}
+		if err := fl.lockShared(ctx, lockName, fl.intentFilename(lockName)); err != nil {
+			return err
+		}
+		if fl.mode != ModeShared {
+			if err := fl.lockWriter(ctx, lockName); err != nil {
+				_ = fl.fileLock(fl.intentFilename(lockName)).Unlock()
+				return err
+			}
+		}
+	}
+	fl.intents[lockName]++
+	return nil
+}
+
+// lockWriter locks a parent group's writers file shared once none of its
+// shared holders remain, which the readers file is locked exclusively to
+// wait for
+func (fl *FileLocker) lockWriter(ctx context.Context, lockName string) error {
+	readers := fl.readersFilename(lockName)
+	if err := fl.lockOne(ctx, lockName, readers, false); err != nil {
+		return err
+	}
+	defer fl.fileLock(readers).Unlock()
+
+	return fl.lockOne(ctx, lockName, fl.writersFilename(lockName), true)
+}
+
+// releaseIntents drops intent locks in the reverse of the order they were
+// taken, unlocking each intent file once nothing this locker holds needs it
+func (fl *FileLocker) releaseIntents(lockNames []string) error {
+	var errs []error
+	for _, lockName := range slices.Backward(lockNames) {
+		fl.intents[lockName]--
+		if fl.intents[lockName] > 0 {
+			continue
+		}
+		delete(fl.intents, lockName)
+		// The writers file is only held for parents, and unlocking it is
+		// harmless otherwise
+		err := errors.Join(
+			fl.fileLock(fl.writersFilename(lockName)).Unlock(),
+			fl.fileLock(fl.intentFilename(lockName)).Unlock(),
+		)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to release intent lock %s: %w", lockName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Release clears the holder metadata and unlocks the lock file, along with
+// the intent locks taken with it
+func (fl *FileLocker) Release(lockName string) error {
+	held, ok := fl.acquired[lockName]
+	if !ok {
+		return fmt.Errorf("lock %s does not exist", lockName)
+	}
+
+	if fl.holder != nil {
+		_ = writeHolder(fl.fs, held.fileLock.Path(), nil)
+	}
+
+	if err := held.fileLock.Unlock(); err != nil {
+		return fmt.Errorf("failed to release lock %s: %w", lockName, err)
+	}
+	if fl.mode == ModeShared {
+		if err := fl.fileLock(fl.readersFilename(lockName)).Unlock(); err != nil {
+			return fmt.Errorf("failed to release lock %s: %w", lockName, err)
+		}
+	}
+	delete(fl.acquired, lockName)
+
+	return fl.releaseIntents(held.intents)
+}
+
+// AcquireJobSlot locks the first free one of the host's max_jobs job slot
+// files, which live directly in the lock directory so that they are shared by
+// every group
+func (fl *FileLocker) AcquireJobSlot(ctx context.Context) error {
+	if fl.jobSlot != nil {
+		return fmt.Errorf("a job slot is already held")
+	}
+	if err := fl.fs.MkdirAll(fl.cfg.LockDir, 0755); err != nil {
+		return fmt.Errorf("error creating lock directory: %w", err)
+	}
+
+	filenames := make([]string, fl.cfg.MaxJobs)
+	for i := range filenames {
+		filenames[i] = fl.jobSlotFilename(i + 1)
+	}
+	slot, err := fl.lockAny(ctx, "job slot", filenames, false)
+	if err != nil {
+		return err
+	}
+	fl.jobSlot = fl.fileLock(filenames[slot])
+	return nil
+}
+
+// ReleaseJobSlot unlocks the job slot file held by AcquireJobSlot
+func (fl *FileLocker) ReleaseJobSlot() error {
+	if fl.jobSlot == nil {
+		return fmt.Errorf("no job slot is held")
+	}
+	if err := fl.jobSlot.Unlock(); err != nil {
+		return fmt.Errorf("failed to release job slot: %w", err)
+	}
+	fl.jobSlot = nil
+	return nil
+}
+
+// SetHolder sets the metadata written into lock files once they are acquired
+func (fl *FileLocker) SetHolder(holder Holder) {
+	fl.holder = &holder
+}
+
+// UpdateHolder rewrites the metadata of the lock files held exclusively, and
+// sets it for locks acquired after the call. As when locks are acquired,
+// failures to write it are ignored
+func (fl *FileLocker) UpdateHolder(holder Holder) error {
+	fl.holder = &holder
+	for _, held := range fl.acquired {
+		if held.holder == nil {
+			continue
+		}
+		updated := updatedHolder(holder, held.holder)
+		_ = writeHolder(fl.fs, held.fileLock.Path(), &updated)
+		held.holder = &updated
+	}
+	return nil
+}
+
+// SetPriority sets the priority of locks acquired after the call, in place
+// of the priority configured for their groups
+func (fl *FileLocker) SetPriority(priority int) {
+	fl.priority = &priority
+}
+
+// SetMode sets whether locks acquired after the call are held shared or
+// exclusively
+func (fl *FileLocker) SetMode(mode Mode) {
+	fl.mode = mode
+}
+
+// List reports the state of every lock file in the lock directory, including
+// those of nested groups. Groups that allow several concurrent jobs are
+// reported once per slot.
+//
+// A lock file whose holder is recorded in it is reported as held without
+// taking it. Any other lock file is probed by briefly locking it, so a job
+// trying for that group without waiting at the same moment may find it
+// locked
+func (fl *FileLocker) List() ([]LockInfo, error) {
+	entries, err := fl.fs.ReadDir(fl.cfg.LockDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading lock directory: %w", err)
+	}
+
+	var locks []LockInfo
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if locks, err = fl.listGroup(locks, entry.Name()); err != nil {
+			return nil, err
+		}
+	}
+	return locks, nil
+}
+
+// listGroup appends the state of a group's lock files to locks, followed by
+// those of its subgroups
+func (fl *FileLocker) listGroup(locks []LockInfo, group string) ([]LockInfo, error) {
+	groupLockDir := filepath.Join(fl.cfg.LockDir, filepath.FromSlash(group))
+	files, err := fl.fs.ReadDir(groupLockDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading lock directory for group '%s': %w", group, err)
+	}
+
+	var (
+		subgroups []string
+		queued    bool
+	)
+	for _, file := range files {
+		if file.IsDir() {
+			subgroups = append(subgroups, group+"/"+file.Name())
+			continue
+		}
+		if _, ok := fl.parseTicket(file.Name()); ok {
+			queued = true
+			continue
+		}
+		slot, ok := fl.parseSlot(file.Name())
+		if !ok {
+			continue
+		}
+		filename := filepath.Join(groupLockDir, file.Name())
+
+		info := LockInfo{Group: group, Slot: slot}
+		if info.Holder, err = fl.recordedHolder(filename); err != nil {
+			return nil, err
+		}
+		if info.Holder != nil {
+			info.Held, info.Mode = true, ModeExclusive
+		} else if info.Held, info.Mode, err = fl.probe(filename); err != nil {
+			return nil, err
+		}
+		locks = append(locks, info)
+	}
+
+	if queued {
+		waiters, err := fl.listTickets(group)
+		if err != nil {
+			return nil, err
+		}
+		locks = append(locks, waiters...)
+	}
+
+	for _, subgroup := range subgroups {
+		if locks, err = fl.listGroup(locks, subgroup); err != nil {
+			return nil, err
+		}
+	}
+	return locks, nil
+}
+
+// Holders returns the holders recorded in the group's lock files that still
+// hold them. It never takes a lock held by a live holder, so it is safe to
+// call while Acquire is waiting, even before the group's lock files exist
+func (fl *FileLocker) Holders(lockName string) ([]Holder, error) {
+	var holders []Holder
+	for _, filename := range fl.lockFilenames(lockName) {
+		holder, err := fl.recordedHolder(filename)
+		if err != nil {
+			return nil, err
+		}
+		if holder != nil {
+			holders = append(holders, *holder)
+		}
+	}
+	return holders, nil
+}
+
+// recordedHolder returns the holder recorded in a lock file, provided it
+// still holds the file exclusively. The file is only probed if it records a
+// holder, and then with a shared lock, which fails without taking the file
+// while the holder is alive. Metadata left behind by a holder that died is
+// ignored
+func (fl *FileLocker) recordedHolder(filename string) (*Holder, error) {
+	holder, err := ReadHolder(fl.fs, filename)
+	if err != nil || holder == nil {
+		// Missing, empty and half-written metadata alike record no holder
+		return nil, nil
+	}
+
+	probe := flock.New(filename, flock.SetFlag(os.O_RDONLY))
+	defer probe.Close()
+	free, err := probe.TryRLock()
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to probe lock file %s: %w", filename, err)
+	}
+	if free {
+		return nil, probe.Unlock()
+	}
+	return holder, nil
+}
+
+// parseSlot reports whether name is a lock file, and its slot number if it is
+// a slot file
+func (fl *FileLocker) parseSlot(name string) (int, bool) {
+	if name == fl.cfg.LockFileName {
+		return 0, true
+	}
+	suffix, ok := strings.CutPrefix(name, fl.cfg.LockFileName+".")
+	if !ok {
+		return 0, false
+	}
+	slot, err := strconv.Atoi(suffix)
+	if err != nil || slot < 1 {
+		return 0, false
+	}
+	return slot, true
+}
+
+// probe reports whether a lock file is currently locked, and in which mode,
+// by trying to lock it without blocking. A free file is briefly locked by the
+// probe
+func (fl *FileLocker) probe(filename string) (bool, Mode, error) {
+	probe := flock.New(filename)
+	defer probe.Close()
+
+	locked, err := probe.TryLock()
+	if err != nil {
+		return false, "", fmt.Errorf("failed to probe lock file %s: %w", filename, err)
+	}
+	if locked {
+		return false, "", probe.Unlock()
+	}
+
+	// Held, but shared if a shared lock can still be taken
+	shared, err := probe.TryRLock()
+	if err != nil {
+		return false, "", fmt.Errorf("failed to probe lock file %s: %w", filename, err)
+	}
+	if shared {
+		return true, ModeShared, probe.Unlock()
+	}
+	return true, ModeExclusive, nil
+}
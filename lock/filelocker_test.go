@@ -0,0 +1,661 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+)
+
+func newTestFileLocker(t *testing.T) *FileLocker {
+	t.Helper()
+	cfg := &config.Config{
+		LockDir:      t.TempDir(),
+		LockFileName: ".lockfile",
+	}
+	locker, err := NewFileLocker(cfg, filesystem.OSFileSystem{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return locker.(*FileLocker)
+}
+
+func TestFileLocker_Holder(t *testing.T) {
+	locker := newTestFileLocker(t)
+	locker.SetHolder(NewHolder("run1", []string{"/bin/backup", "--full"}))
+
+	if err := locker.Acquire(context.Background(), "backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	holder, err := ReadHolder(locker.fs, locker.lockFilename("backup"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if holder == nil {
+		t.Fatalf("expected holder metadata in the lock file")
+	}
+	if holder.RunID != "run1" || len(holder.Command) != 2 || holder.Acquired.IsZero() {
+		t.Errorf("unexpected holder metadata %+v", holder)
+	}
+
+	if err := locker.Release("backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	holder, err = ReadHolder(locker.fs, locker.lockFilename("backup"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if holder != nil {
+		t.Errorf("expected holder metadata to be cleared, got %+v", holder)
+	}
+}
+
+func TestFileLocker_UpdateHolder(t *testing.T) {
+	locker := newTestFileLocker(t)
+	locker.cfg.Groups = map[string]config.GroupConfig{
+		"thumbnailers": {MaxConcurrency: 2},
+	}
+	holder := NewHolder("run1", []string{"/bin/backup"})
+	locker.SetHolder(holder)
+	for _, group := range []string{"backup", "thumbnailers"} {
+		if err := locker.Acquire(context.Background(), group); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	acquired, _ := ReadHolder(locker.fs, locker.lockFilename("backup"))
+
+	// Once the job has started, its own process group is recorded
+	holder.PGID = 4242
+	if err := locker.UpdateHolder(holder); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	updated, err := ReadHolder(locker.fs, locker.lockFilename("backup"))
+	if err != nil || updated == nil || updated.PGID != 4242 || !updated.Acquired.Equal(acquired.Acquired) {
+		t.Errorf("expected the process group to be recorded and the acquisition kept, got %+v, %v", updated, err)
+	}
+	updated, err = ReadHolder(locker.fs, locker.slotFilename("thumbnailers", 1))
+	if err != nil || updated == nil || updated.PGID != 4242 || updated.Slot != 1 {
+		t.Errorf("expected the process group to be recorded and the slot kept, got %+v, %v", updated, err)
+	}
+}
+
+func TestFileLocker_List(t *testing.T) {
+	locker := newTestFileLocker(t)
+	locker.SetHolder(NewHolder("run1", []string{"/bin/backup"}))
+
+	for _, group := range []string{"backup", "sync"} {
+		if err := locker.Acquire(context.Background(), group); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := locker.Release("sync"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	locks, err := locker.List()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(locks) != 2 {
+		t.Fatalf("expected 2 locks, got %+v", locks)
+	}
+	if locks[0].Group != "backup" || !locks[0].Held || locks[0].Holder == nil || locks[0].Holder.RunID != "run1" {
+		t.Errorf("expected backup to be held by run1, got %+v", locks[0])
+	}
+	if locks[1].Group != "sync" || locks[1].Held || locks[1].Holder != nil {
+		t.Errorf("expected sync to be free, got %+v", locks[1])
+	}
+}
+
+func TestFileLocker_Holders(t *testing.T) {
+	locker := newTestFileLocker(t)
+	locker.SetHolder(NewHolder("run1", []string{"/bin/backup"}))
+	other, _ := NewFileLocker(locker.cfg, locker.fs)
+
+	// Groups nobody has locked yet are not created by looking at them
+	holders, err := other.(HolderLister).Holders("backup")
+	if err != nil || holders != nil {
+		t.Fatalf("expected no holders, got %+v, %v", holders, err)
+	}
+	if _, err := os.Stat(filepath.Join(locker.cfg.LockDir, "backup")); !os.IsNotExist(err) {
+		t.Errorf("expected the group not to be created, got %v", err)
+	}
+
+	if err := locker.Acquire(context.Background(), "backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	holders, err = other.(HolderLister).Holders("backup")
+	if err != nil || len(holders) != 1 || holders[0].RunID != "run1" {
+		t.Errorf("expected run1 to hold backup, got %+v, %v", holders, err)
+	}
+
+	// Metadata left behind by a holder that died is ignored
+	if err := locker.Release("backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	dead := NewHolder("run0", []string{"/bin/backup"})
+	if err := writeHolder(locker.fs, locker.lockFilename("backup"), &dead); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	holders, err = other.(HolderLister).Holders("backup")
+	if err != nil || holders != nil {
+		t.Errorf("expected no holders, got %+v, %v", holders, err)
+	}
+	locks, err := other.(Lister).List()
+	if err != nil || len(locks) != 1 || locks[0].Held {
+		t.Errorf("expected backup to be free, got %+v, %v", locks, err)
+	}
+}
+
+func TestFileLocker_MaxConcurrency(t *testing.T) {
+	first := newTestFileLocker(t)
+	first.cfg.Groups = map[string]config.GroupConfig{
+		"thumbnailers": {MaxConcurrency: 2},
+	}
+	second, _ := NewFileLocker(first.cfg, first.fs)
+	third, _ := NewFileLocker(first.cfg, first.fs)
+	third.SetHolder(NewHolder("run3", []string{"/bin/thumbnail"}))
+
+	for _, locker := range []Locker{first, second} {
+		if err := locker.Acquire(context.Background(), "thumbnailers"); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	// Both slots are held, so a third job has to wait
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	if err := third.Acquire(ctx, "thumbnailers"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expected lock timeout, got %v", err)
+	}
+
+	if err := first.Release("thumbnailers"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := third.Acquire(context.Background(), "thumbnailers"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	holder, err := ReadHolder(first.fs, first.slotFilename("thumbnailers", 1))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if holder == nil || holder.RunID != "run3" || holder.Slot != 1 {
+		t.Errorf("expected run3 to hold slot 1, got %+v", holder)
+	}
+}
+
+func TestFileLocker_MaxConcurrencyTimeoutLeavesNoWaits(t *testing.T) {
+	first := newTestFileLocker(t)
+	first.cfg.Groups = map[string]config.GroupConfig{
+		"thumbnailers": {MaxConcurrency: 2},
+	}
+	second, _ := NewFileLocker(first.cfg, first.fs)
+	waiter, _ := NewFileLocker(first.cfg, first.fs)
+
+	for _, locker := range []Locker{first, second} {
+		if err := locker.Acquire(context.Background(), "thumbnailers"); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	// A wait left blocked on a slot would take it once freed, keeping others
+	// from trying it
+	goroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := waiter.Acquire(ctx, "thumbnailers"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expected lock timeout, got %v", err)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("expected no waits left blocked, %d goroutines remain of %d", n, goroutines)
+	}
+}
+
+func TestFileLocker_SharedMode(t *testing.T) {
+	reader := newTestFileLocker(t)
+	reader.SetMode(ModeShared)
+	otherReader, _ := NewFileLocker(reader.cfg, reader.fs)
+	otherReader.(*FileLocker).SetMode(ModeShared)
+	writer, _ := NewFileLocker(reader.cfg, reader.fs)
+	lateReader, _ := NewFileLocker(reader.cfg, reader.fs)
+	lateReader.(*FileLocker).SetMode(ModeShared)
+
+	// Shared holders coexist
+	for _, locker := range []Locker{reader, otherReader} {
+		if err := locker.Acquire(context.Background(), "db"); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- writer.Acquire(context.Background(), "db")
+	}()
+
+	// Once the writer is waiting, new shared holders are kept out
+	deadline := time.Now().Add(time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 0)
+		err := lateReader.Acquire(ctx, "db")
+		cancel()
+		if errors.Is(err, ErrLockTimeout) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if err := lateReader.Release("db"); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected shared holders to be kept out while the writer waits")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, locker := range []Locker{reader, otherReader} {
+		if err := locker.Release("db"); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the writer to acquire the lock")
+	}
+}
+
+func TestFileLocker_NestedGroups(t *testing.T) {
+	backup := newTestFileLocker(t)
+	vacuum, _ := NewFileLocker(backup.cfg, backup.fs)
+	parent, _ := NewFileLocker(backup.cfg, backup.fs)
+
+	// Jobs in sibling subgroups do not exclude each other
+	if err := backup.Acquire(context.Background(), "db/backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := vacuum.Acquire(context.Background(), "db/vacuum"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// The parent group waits for every job in its subgroups
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	if err := parent.Acquire(ctx, "db"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expected lock timeout, got %v", err)
+	}
+	for _, release := range []func() error{
+		func() error { return backup.Release("db/backup") },
+		func() error { return vacuum.Release("db/vacuum") },
+	} {
+		if err := release(); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := parent.Acquire(context.Background(), "db"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// and once held, keeps them out
+	if err := backup.Acquire(ctx, "db/backup"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expected lock timeout, got %v", err)
+	}
+
+	// A locker holding the parent may still take its subgroups
+	if err := parent.Acquire(context.Background(), "db/backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, group := range []string{"db/backup", "db"} {
+		if err := parent.Release(group); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := backup.Acquire(context.Background(), "db/backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	locks, err := backup.List()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var groups []string
+	for _, l := range locks {
+		groups = append(groups, l.Group)
+	}
+	if want := []string{"db", "db/backup", "db/vacuum"}; !slices.Equal(groups, want) {
+		t.Errorf("expected locks %v, got %v", want, groups)
+	}
+}
+
+func TestFileLocker_SharedParent(t *testing.T) {
+	reader := newTestFileLocker(t)
+	reader.SetMode(ModeShared)
+	subReader, _ := NewFileLocker(reader.cfg, reader.fs)
+	subReader.(*FileLocker).SetMode(ModeShared)
+	writer, _ := NewFileLocker(reader.cfg, reader.fs)
+
+	if err := reader.Acquire(context.Background(), "db"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// A shared holder of the parent lets shared subgroup jobs in
+	if err := subReader.Acquire(context.Background(), "db/backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// but keeps exclusive ones out
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	if err := writer.Acquire(ctx, "db/backup"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expected lock timeout, got %v", err)
+	}
+	if err := reader.Release("db"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := subReader.Release("db/backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := writer.Acquire(context.Background(), "db/backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// and an exclusive subgroup job keeps shared holders of the parent out
+	if err := reader.Acquire(ctx, "db"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expected lock timeout, got %v", err)
+	}
+	if err := writer.Release("db/backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := reader.Acquire(context.Background(), "db"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestFileLocker_OverlappingNestedGroups(t *testing.T) {
+	first := newTestFileLocker(t)
+	second, _ := NewFileLocker(first.cfg, first.fs)
+
+	// "b-z" sorts between "b" and "b/y" as a plain string, which let each
+	// job hold a lock the other waits for
+	firstGroups := slices.SortedFunc(slices.Values([]string{"b-z", "b/y"}), CompareGroups)
+	secondGroups := slices.SortedFunc(slices.Values([]string{"b-z", "b"}), CompareGroups)
+	if err := first.Acquire(context.Background(), firstGroups[0]); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, group := range secondGroups {
+			if err := second.Acquire(ctx, group); err != nil {
+				acquired <- err
+				return
+			}
+		}
+		acquired <- nil
+	}()
+	// Give the second job time to take whatever it can
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, group := range firstGroups[1:] {
+		if err := first.Acquire(ctx, group); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	for _, group := range slices.Backward(firstGroups) {
+		if err := first.Release(group); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := <-acquired; err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestValidateGroup(t *testing.T) {
+	for _, group := range []string{"backup", "db/backup", "db/backup/full", "sync-1.2"} {
+		if err := ValidateGroup(group); err != nil {
+			t.Errorf("ValidateGroup(%q): expected no error, got %v", group, err)
+		}
+	}
+	for _, group := range []string{"", ".", "..", "../etc", "db/../..", "/etc", "db/", "db//backup", "./db", `db\backup`} {
+		if err := ValidateGroup(group); !errors.Is(err, ErrInvalidGroup) {
+			t.Errorf("ValidateGroup(%q): expected ErrInvalidGroup, got %v", group, err)
+		}
+	}
+}
+
+func TestFileLocker_MaxJobs(t *testing.T) {
+	first := newTestFileLocker(t)
+	first.cfg.MaxJobs = 1
+	second, _ := NewFileLocker(first.cfg, first.fs)
+
+	// Jobs in different groups share the host's job slots
+	if err := first.Acquire(context.Background(), "backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := first.AcquireJobSlot(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := second.Acquire(context.Background(), "sync"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	if err := second.(JobLimiter).AcquireJobSlot(ctx); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expected lock timeout, got %v", err)
+	}
+
+	if err := first.ReleaseJobSlot(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := second.(JobLimiter).AcquireJobSlot(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+// waitForQueue waits until n waiters are queued for a lock, and returns them
+func waitForQueue(t *testing.T, locker *FileLocker, n int) []LockInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		locks, err := locker.List()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		var waiters []LockInfo
+		for _, l := range locks {
+			if l.Position > 0 {
+				waiters = append(waiters, l)
+			}
+		}
+		if len(waiters) == n {
+			return waiters
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiters, got %+v", n, waiters)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileLocker_Fair(t *testing.T) {
+	holder := newTestFileLocker(t)
+	holder.cfg.Fair = true
+	first, _ := NewFileLocker(holder.cfg, holder.fs)
+	first.SetHolder(NewHolder("run1", []string{"/bin/backup"}))
+	second, _ := NewFileLocker(holder.cfg, holder.fs)
+	second.SetHolder(NewHolder("run2", []string{"/bin/backup"}))
+
+	if err := holder.Acquire(context.Background(), "db"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	firstAcquired := make(chan error, 1)
+	go func() { firstAcquired <- first.Acquire(context.Background(), "db") }()
+	waitForQueue(t, holder, 1)
+	secondAcquired := make(chan error, 1)
+	go func() { secondAcquired <- second.Acquire(context.Background(), "db") }()
+
+	waiters := waitForQueue(t, holder, 2)
+	for i, runID := range []string{"run1", "run2"} {
+		if waiters[i].Position != i+1 || waiters[i].Holder == nil || waiters[i].Holder.RunID != runID {
+			t.Errorf("expected %s at position %d, got %+v", runID, i+1, waiters[i])
+		}
+	}
+
+	// The waiters acquire the group in the order they arrived
+	if err := holder.Release("db"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	select {
+	case err := <-firstAcquired:
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	case err := <-secondAcquired:
+		t.Fatalf("expected the first waiter to acquire the lock, the second got %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the first waiter to acquire the lock")
+	}
+	waitForQueue(t, holder, 1)
+
+	if err := first.Release("db"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	select {
+	case err := <-secondAcquired:
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatalf("expected the second waiter to acquire the lock")
+	}
+}
+
+func TestFileLocker_WakesOnRelease(t *testing.T) {
+	holder := newTestFileLocker(t)
+	waiter, _ := NewFileLocker(holder.cfg, holder.fs)
+
+	if err := holder.Acquire(context.Background(), "backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	acquired := make(chan time.Time, 1)
+	go func() {
+		if err := waiter.Acquire(context.Background(), "backup"); err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		acquired <- time.Now()
+	}()
+
+	// Long enough for a polling waiter to have backed off
+	time.Sleep(2 * time.Second)
+	released := time.Now()
+	if err := holder.Release("backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	select {
+	case at := <-acquired:
+		if lag := at.Sub(released); lag > 250*time.Millisecond {
+			t.Errorf("expected the waiter to acquire the lock promptly, took %s", lag)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the waiter to acquire the lock")
+	}
+}
+
+func TestFileLocker_CancelWhileWaiting(t *testing.T) {
+	holder := newTestFileLocker(t)
+	waiter, _ := NewFileLocker(holder.cfg, holder.fs)
+	next, _ := NewFileLocker(holder.cfg, holder.fs)
+
+	if err := holder.Acquire(context.Background(), "backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() { canceled <- waiter.Acquire(ctx, "backup") }()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-canceled:
+		if !errors.Is(err, ErrLockCanceled) {
+			t.Fatalf("expected lock canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the wait to be canceled")
+	}
+
+	// The abandoned wait does not keep the lock from later waiters
+	if err := holder.Release("backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := next.Acquire(ctx, "backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestFileLocker_Priority(t *testing.T) {
+	holder := newTestFileLocker(t)
+	routine, _ := NewFileLocker(holder.cfg, holder.fs)
+	urgent, _ := NewFileLocker(holder.cfg, holder.fs)
+	urgent.(*FileLocker).SetPriority(10)
+
+	if err := holder.Acquire(context.Background(), "db"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	routineAcquired := make(chan error, 1)
+	go func() { routineAcquired <- routine.Acquire(context.Background(), "db") }()
+	waitForQueue(t, holder, 1)
+	urgentAcquired := make(chan error, 1)
+	go func() { urgentAcquired <- urgent.Acquire(context.Background(), "db") }()
+
+	// The urgent job is queued ahead of the routine one that arrived first
+	waiters := waitForQueue(t, holder, 2)
+	if waiters[0].Priority != 10 || waiters[1].Priority != 0 {
+		t.Errorf("expected the urgent job at the front of the queue, got %+v", waiters)
+	}
+
+	if err := holder.Release("db"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	select {
+	case err := <-urgentAcquired:
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	case err := <-routineAcquired:
+		t.Fatalf("expected the urgent job to acquire the lock, the routine one got %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the urgent job to acquire the lock")
+	}
+
+	if err := urgent.Release("db"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	select {
+	case err := <-routineAcquired:
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the routine job to acquire the lock")
+	}
+}
@@ -0,0 +1,50 @@
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ErrInvalidGroup is returned for group names that are not a relative path
+// inside the lock directory.
+var ErrInvalidGroup = errors.New("invalid group name")
+
+// ValidateGroup checks that a group name is a clean, slash separated relative
+// path, so that its lock files cannot escape the lock directory.
+func ValidateGroup(group string) error {
+	switch {
+	case group == "":
+		return fmt.Errorf("%w: empty", ErrInvalidGroup)
+	case strings.ContainsAny(group, "\\\x00"):
+		return fmt.Errorf("%w %q: must not contain backslashes", ErrInvalidGroup, group)
+	case group == ".", path.Clean(group) != group, !filepath.IsLocal(filepath.FromSlash(group)):
+		return fmt.Errorf("%w %q: must be a relative path without empty, '.' or '..' elements", ErrInvalidGroup, group)
+	}
+	return nil
+}
+
+// CompareGroups orders groups by their slash separated elements, so that a
+// group sorts right after its parent and its parent's other subgroups, and
+// before groups whose names merely start with the parent's: "b", "b/y",
+// "b-z". Jobs that lock their groups in this order take every lock, including
+// the intent locks of the parents, in the same order, so that two jobs with
+// overlapping groups cannot each hold a lock the other is waiting for.
+func CompareGroups(a, b string) int {
+	return slices.Compare(strings.Split(a, "/"), strings.Split(b, "/"))
+}
+
+// parentGroups returns the ancestors of a group, outermost first. The parents
+// of "db/backup/full" are "db" and "db/backup".
+func parentGroups(group string) []string {
+	var parents []string
+	for i, c := range group {
+		if c == '/' {
+			parents = append(parents, group[:i])
+		}
+	}
+	return parents
+}
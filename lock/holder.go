@@ -0,0 +1,99 @@
+package lock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/filesystem"
+)
+
+// Holder describes the process holding a lock. It is written into the lock
+// file while the lock is held so that tooling can tell who holds a group.
+type Holder struct {
+	PID int `json:"pid"`
+	// PGID is the process group of the holder, where supported. Once the
+	// job has started in a process group of its own, it is the job's.
+	PGID     int      `json:"pgid,omitempty"`
+	Hostname string   `json:"hostname"`
+	User     string   `json:"user"`
+	Command  []string `json:"command"`
+	RunID    string   `json:"run_id"`
+	// Slot is the slot held in a group that allows several concurrent jobs.
+	Slot     int       `json:"slot,omitempty"`
+	Started  time.Time `json:"started"`
+	Acquired time.Time `json:"acquired,omitempty"`
+}
+
+// NewHolder describes the current process running the given command.
+func NewHolder(runID string, command []string) Holder {
+	hostname, _ := os.Hostname()
+	username := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	return Holder{
+		PID:      os.Getpid(),
+		PGID:     processGroup(),
+		Hostname: hostname,
+		User:     username,
+		Command:  command,
+		RunID:    runID,
+		Started:  time.Now(),
+	}
+}
+
+// updatedHolder returns holder as recorded for a lock that was recorded as
+// held by recorded, keeping when it was acquired and its slot.
+func updatedHolder(holder Holder, recorded *Holder) Holder {
+	if recorded != nil {
+		holder.Acquired = recorded.Acquired
+		holder.Slot = recorded.Slot
+	}
+	return holder
+}
+
+// writeHolder replaces the contents of the lock file with the holder
+// metadata, or empties it if holder is nil.
+func writeHolder(fs filesystem.FileSystem, filename string, holder *Holder) error {
+	file, err := fs.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if holder == nil {
+		return nil
+	}
+	if err := json.NewEncoder(file).Encode(holder); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// ReadHolder reads the holder metadata from a lock file. It returns nil if
+// the lock file is empty, which is the case when the lock is not held.
+func ReadHolder(fs filesystem.FileSystem, filename string) (*Holder, error) {
+	file, err := fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var holder Holder
+	if err := json.Unmarshal(data, &holder); err != nil {
+		return nil, fmt.Errorf("invalid lock holder in %s: %w", filename, err)
+	}
+	return &holder, nil
+}
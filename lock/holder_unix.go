@@ -0,0 +1,10 @@
+//go:build !windows
+
+package lock
+
+import "syscall"
+
+// processGroup returns the process group of the current process.
+func processGroup() int {
+	return syscall.Getpgrp()
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package lock
+
+// processGroup returns zero as process groups are not supported on Windows.
+func processGroup() int {
+	return 0
+}
@@ -0,0 +1,423 @@
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+)
+
+// LeaseLocker implements the Locker interface with lease files, for lock
+// directories on shared storage such as NFS where flock is unreliable.
+//
+// A lease is taken by writing it to a file of its own and hard linking that
+// into place as the group's lease file, which fails if the lease file
+// exists. Linking is atomic on NFS, unlike creating a file exclusively on
+// older servers. While the lock is held a heartbeat goroutine renews the
+// lease by renaming a copy with a later expiry over it. A lease that has
+// expired belongs to a holder that died or lost touch with the storage, and
+// any host may take it over, so the hosts' clocks must be kept in sync. The
+// holder whose lease was taken over finds out when it next renews it: the
+// channel returned by Lost is closed, and Release returns ErrLeaseLost.
+//
+// Leases are always exclusive and groups are locked independently of their
+// subgroups. Waiting jobs poll the lease, so priorities are not honoured.
+type LeaseLocker struct {
+	cfg      *config.Config
+	settings LeaseConfig
+	fs       filesystem.FileSystem
+	hostname string
+	leases   map[string]*heldLease // keyed by lock name
+	holder   *Holder
+	lost     lossSignal
+}
+
+// LeaseConfig configures the nfs-lease lock backend. It is read from the
+// nfs_lease table of the configuration.
+type LeaseConfig struct {
+	// LeaseDuration is how long a lease is valid without being renewed. It
+	// is renewed three times per duration while the lock is held, and other
+	// hosts may take it over once it expires.
+	LeaseDuration config.Duration `toml:"lease_duration"`
+	// PollInterval is how often a waiting job checks whether the lease has
+	// been released or has expired.
+	PollInterval config.Duration `toml:"poll_interval"`
+}
+
+// DefaultLeaseConfig holds the settings of the nfs-lease backend that the
+// configuration does not set.
+var DefaultLeaseConfig = LeaseConfig{
+	LeaseDuration: config.Duration(30 * time.Second),
+	PollInterval:  config.Duration(time.Second),
+}
+
+// lease is the content of a lease file
+type lease struct {
+	// Token identifies the acquisition that took the lease, so that a holder
+	// can tell its lease from one that took it over.
+	Token    string    `json:"token"`
+	Hostname string    `json:"hostname"`
+	Expires  time.Time `json:"expires"`
+	Holder   *Holder   `json:"holder,omitempty"`
+}
+
+// heldLease is a lease held by a LeaseLocker
+type heldLease struct {
+	// mu guards the lease, which the renewer updates
+	mu      sync.Mutex
+	lease   lease
+	renewer *renewer
+}
+
+// NewLeaseLocker creates a new LeaseLocker that keeps its lease files in the
+// lock directory
+func NewLeaseLocker(cfg *config.Config, fs filesystem.FileSystem) (Locker, error) {
+	settings := DefaultLeaseConfig
+	if err := cfg.Section("nfs_lease", &settings); err != nil {
+		return nil, err
+	}
+	if settings.LeaseDuration <= 0 {
+		return nil, fmt.Errorf("%w: nfs_lease.lease_duration: must be positive", config.ErrConfigInvalid)
+	}
+	if settings.PollInterval <= 0 {
+		return nil, fmt.Errorf("%w: nfs_lease.poll_interval: must be positive", config.ErrConfigInvalid)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("error getting hostname: %w", err)
+	}
+	return &LeaseLocker{
+		cfg:      cfg,
+		settings: settings,
+		fs:       fs,
+		hostname: hostname,
+		leases:   make(map[string]*heldLease),
+	}, nil
+}
+
+// leaseFilename returns the path of a group's lease file
+func (ll *LeaseLocker) leaseFilename(lockName string) string {
+	return filepath.Join(ll.cfg.LockDir, filepath.FromSlash(lockName), ll.cfg.LockFileName+".lease")
+}
+
+// Acquire takes the group's lease, polling until it is released or expires
+// or ctx is done, and starts renewing it
+func (ll *LeaseLocker) Acquire(ctx context.Context, lockName string) error {
+	if err := ValidateGroup(lockName); err != nil {
+		return err
+	}
+	if ll.cfg.ForGroup(lockName).MaxConcurrency > 1 {
+		return fmt.Errorf("lock %s allows several concurrent jobs, which the nfs-lease backend does not support", lockName)
+	}
+	if _, ok := ll.leases[lockName]; ok {
+		return fmt.Errorf("lock %s is already held", lockName)
+	}
+	if err := ll.fs.MkdirAll(filepath.Dir(ll.leaseFilename(lockName)), 0755); err != nil {
+		return fmt.Errorf("error creating lock directory for group '%s': %w", lockName, err)
+	}
+
+	l := lease{Token: newToken(), Hostname: ll.hostname}
+	if ll.holder != nil {
+		holder := *ll.holder
+		holder.Acquired = time.Now()
+		l.Holder = &holder
+	}
+	for {
+		l.Expires = time.Now().Add(time.Duration(ll.settings.LeaseDuration))
+		taken, err := ll.takeLease(lockName, l)
+		if err != nil {
+			return fmt.Errorf("failed to acquire lock %s: %w", lockName, err)
+		}
+		if taken {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return contextError(ctx, lockName)
+		case <-time.After(time.Duration(ll.settings.PollInterval)):
+		}
+	}
+
+	// The lease is renewed three times per lease duration, so that a single
+	// failed renewal does not lose it
+	ll.lost.open()
+	held := &heldLease{lease: l}
+	held.renewer = startRenewer(time.Duration(ll.settings.LeaseDuration)/3, func() error {
+		return ll.renew(lockName, held)
+	}, ll.lost.lose)
+	ll.leases[lockName] = held
+	return nil
+}
+
+// takeLease tries once to take the group's lease, taking over an expired
+// lease, and reports whether it did
+func (ll *LeaseLocker) takeLease(lockName string, l lease) (bool, error) {
+	filename := ll.leaseFilename(lockName)
+	for {
+		err := ll.linkLease(filename, l)
+		if !os.IsExist(err) {
+			return err == nil, err
+		}
+
+		current, err := ll.readLease(filename)
+		switch {
+		case os.IsNotExist(err):
+			// Released since we tried
+			continue
+		case err != nil:
+			return false, err
+		case time.Now().Before(current.Expires):
+			return false, nil
+		}
+		if err := ll.breakLease(filename, current); err != nil {
+			return false, err
+		}
+	}
+}
+
+// linkLease writes a lease to a file of its own and links it into place as
+// filename, failing with an error satisfying os.IsExist if filename exists
+func (ll *LeaseLocker) linkLease(filename string, l lease) error {
+	tmp := filename + "." + l.Token
+	if err := ll.writeLease(tmp, l, os.O_EXCL); err != nil {
+		return err
+	}
+	defer ll.fs.Remove(tmp)
+
+	err := ll.fs.Link(tmp, filename)
+	if err != nil && !os.IsExist(err) {
+		// The reply to a link that succeeded may be lost on NFS, in which
+		// case the retried link fails, so check whose lease is in place
+		if current, readErr := ll.readLease(filename); readErr == nil && current.Token == l.Token {
+			return nil
+		}
+	}
+	return err
+}
+
+// breakLease removes an expired lease. It is first renamed aside, and put
+// back if it turns out another host took the lease over in the meantime
+func (ll *LeaseLocker) breakLease(filename string, expired lease) error {
+	broken := filename + ".broken." + newToken()
+	if err := ll.fs.Rename(filename, broken); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to break expired lease %s: %w", filename, err)
+	}
+	defer ll.fs.Remove(broken)
+
+	if renamed, err := ll.readLease(broken); err == nil && renamed.Token == expired.Token {
+		return nil
+	}
+	// Best effort: if yet another host has linked its lease in meanwhile,
+	// the host whose lease was renamed aside finds it lost when renewing
+	if err := ll.fs.Link(broken, filename); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to restore lease %s: %w", filename, err)
+	}
+	return nil
+}
+
+// renew extends the expiry of a held lease, unless it has been taken over.
+//
+// Checking the lease and renaming the renewed one over it are not atomic, so
+// another host that took the lease over in between would have its lease
+// replaced. Another host only takes over an expired lease, so the lease is
+// given up rather than renewed once it is about to expire: renewals are
+// attempted three times per lease duration, and the rename follows the check
+// by far less than the margin kept
+func (ll *LeaseLocker) renew(lockName string, held *heldLease) error {
+	held.mu.Lock()
+	defer held.mu.Unlock()
+	filename := ll.leaseFilename(lockName)
+	leaseDuration := time.Duration(ll.settings.LeaseDuration)
+	if time.Until(held.lease.Expires) < leaseDuration/6 {
+		return fmt.Errorf("%w for %s: lease expired before it could be renewed", ErrLeaseLost, lockName)
+	}
+	if err := ll.checkLease(lockName, held); err != nil {
+		return err
+	}
+
+	l := held.lease
+	l.Expires = time.Now().Add(leaseDuration)
+
+	tmp := filename + "." + l.Token + ".renew"
+	if err := ll.writeLease(tmp, l, os.O_TRUNC); err != nil {
+		return err
+	}
+	if err := ll.fs.Rename(tmp, filename); err != nil {
+		_ = ll.fs.Remove(tmp)
+		return err
+	}
+
+	held.lease = l
+	return nil
+}
+
+// checkLease returns ErrLeaseLost if the group's lease file no longer holds
+// the held lease
+func (ll *LeaseLocker) checkLease(lockName string, held *heldLease) error {
+	token := held.lease.Token
+	current, err := ll.readLease(ll.leaseFilename(lockName))
+	switch {
+	case os.IsNotExist(err):
+		return fmt.Errorf("%w for %s: lease file was removed", ErrLeaseLost, lockName)
+	case err != nil:
+		return err
+	case current.Token != token:
+		return fmt.Errorf("%w for %s: taken over by %s", ErrLeaseLost, lockName, current.Hostname)
+	}
+	return nil
+}
+
+// Release stops renewing the group's lease and removes it, unless it has
+// been lost to another host, in which case ErrLeaseLost is returned
+func (ll *LeaseLocker) Release(lockName string) error {
+	held, ok := ll.leases[lockName]
+	if !ok {
+		return fmt.Errorf("lock %s is not held", lockName)
+	}
+	delete(ll.leases, lockName)
+	if len(ll.leases) == 0 {
+		defer ll.lost.reset()
+	}
+	if err := held.renewer.Stop(); err != nil {
+		return err
+	}
+	if err := ll.checkLease(lockName, held); err != nil {
+		return err
+	}
+	if err := ll.fs.Remove(ll.leaseFilename(lockName)); err != nil {
+		return fmt.Errorf("failed to release lock %s: %w", lockName, err)
+	}
+	return nil
+}
+
+// Lost returns a channel that is closed once a lease held by the locker is
+// found to have been taken over when renewing it. It never closes while no
+// lease is held
+func (ll *LeaseLocker) Lost() <-chan struct{} {
+	return ll.lost.channel()
+}
+
+// SetHolder sets the metadata recorded in leases taken after the call
+func (ll *LeaseLocker) SetHolder(holder Holder) {
+	ll.holder = &holder
+}
+
+// UpdateHolder records the holder anew in each lease held by renewing it, and
+// sets it for leases taken after the call
+func (ll *LeaseLocker) UpdateHolder(holder Holder) error {
+	ll.holder = &holder
+	var errs []error
+	for lockName, held := range ll.leases {
+		held.mu.Lock()
+		updated := updatedHolder(holder, held.lease.Holder)
+		held.lease.Holder = &updated
+		held.mu.Unlock()
+		if err := ll.renew(lockName, held); err != nil {
+			errs = append(errs, fmt.Errorf("failed to update the holder of lock %s: %w", lockName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// List reports the state of every lease in the lock directory, including
+// those of nested groups. Expired leases are reported as not held
+func (ll *LeaseLocker) List() ([]LockInfo, error) {
+	return ll.listDir(nil, "")
+}
+
+// listDir appends the state of the leases in a group's directory to locks,
+// followed by those of its subgroups. The lock directory itself is the
+// empty group
+func (ll *LeaseLocker) listDir(locks []LockInfo, group string) ([]LockInfo, error) {
+	entries, err := ll.fs.ReadDir(filepath.Join(ll.cfg.LockDir, filepath.FromSlash(group)))
+	if err != nil {
+		return nil, fmt.Errorf("error reading lock directory: %w", err)
+	}
+
+	var subgroups []string
+	for _, entry := range entries {
+		switch {
+		case entry.IsDir():
+			subgroups = append(subgroups, strings.TrimPrefix(group+"/"+entry.Name(), "/"))
+		case group != "" && entry.Name() == ll.cfg.LockFileName+".lease":
+			info := LockInfo{Group: group}
+			if l, err := ll.readLease(ll.leaseFilename(group)); err == nil && time.Now().Before(l.Expires) {
+				info.Held, info.Mode, info.Holder = true, ModeExclusive, l.Holder
+			}
+			locks = append(locks, info)
+		}
+	}
+
+	for _, subgroup := range subgroups {
+		if locks, err = ll.listDir(locks, subgroup); err != nil {
+			return nil, err
+		}
+	}
+	return locks, nil
+}
+
+// Holders returns the holder recorded in the group's lease, unless it is
+// free or has expired
+func (ll *LeaseLocker) Holders(lockName string) ([]Holder, error) {
+	l, err := ll.readLease(ll.leaseFilename(lockName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if l.Holder == nil || !time.Now().Before(l.Expires) {
+		return nil, nil
+	}
+	return []Holder{*l.Holder}, nil
+}
+
+// readLease reads a lease file
+func (ll *LeaseLocker) readLease(filename string) (lease, error) {
+	var l lease
+	file, err := ll.fs.Open(filename)
+	if err != nil {
+		return l, err
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(&l); err != nil {
+		return l, fmt.Errorf("invalid lease in %s: %w", filename, err)
+	}
+	return l, nil
+}
+
+// writeLease writes a lease to a new file, or replaces its contents with
+// os.O_TRUNC
+func (ll *LeaseLocker) writeLease(filename string, l lease, flag int) error {
+	file, err := ll.fs.OpenFile(filename, os.O_WRONLY|os.O_CREATE|flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(l); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// newToken returns a random token identifying a lease
+func newToken() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,152 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+)
+
+func newTestLeaseLocker(t *testing.T, lockDir string, leaseDuration time.Duration) *LeaseLocker {
+	t.Helper()
+	cfg := &config.Config{
+		LockDir:      lockDir,
+		LockFileName: ".lockfile",
+		LockBackend:  "nfs-lease",
+	}
+	if err := cfg.SetSection("nfs_lease", LeaseConfig{
+		LeaseDuration: config.Duration(leaseDuration),
+		PollInterval:  config.Duration(10 * time.Millisecond),
+	}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	locker, err := NewLocker(cfg, filesystem.OSFileSystem{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return locker.(*LeaseLocker)
+}
+
+func TestLeaseLocker_Exclusive(t *testing.T) {
+	lockDir := t.TempDir()
+	first := newTestLeaseLocker(t, lockDir, time.Minute)
+	second := newTestLeaseLocker(t, lockDir, time.Minute)
+	first.SetHolder(NewHolder("run1", []string{"/bin/backup"}))
+
+	if err := first.Acquire(context.Background(), "db/backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := second.Acquire(ctx, "db/backup"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expected a lock timeout, got %v", err)
+	}
+
+	holders, err := second.Holders("db/backup")
+	if err != nil || len(holders) != 1 || holders[0].RunID != "run1" {
+		t.Errorf("expected run1 to hold the lease, got %v, %v", holders, err)
+	}
+	locks, err := second.List()
+	if err != nil || len(locks) != 1 || locks[0].Group != "db/backup" || !locks[0].Held {
+		t.Errorf("expected db/backup to be listed as held, got %+v, %v", locks, err)
+	}
+
+	if err := first.Release("db/backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := second.Acquire(context.Background(), "db/backup"); err != nil {
+		t.Fatalf("expected the released lease to be taken, got %v", err)
+	}
+	if err := second.Release("db/backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestLeaseLocker_Heartbeat(t *testing.T) {
+	lockDir := t.TempDir()
+	first := newTestLeaseLocker(t, lockDir, 150*time.Millisecond)
+	second := newTestLeaseLocker(t, lockDir, 150*time.Millisecond)
+
+	if err := first.Acquire(context.Background(), "backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// The lease outlives several lease durations while it is renewed
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := second.Acquire(ctx, "backup"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expected the renewed lease to be held, got %v", err)
+	}
+	if err := first.Release("backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestLeaseLocker_TakesOverExpiredLease(t *testing.T) {
+	lockDir := t.TempDir()
+	first := newTestLeaseLocker(t, lockDir, time.Minute)
+	second := newTestLeaseLocker(t, lockDir, time.Minute)
+
+	if err := first.Acquire(context.Background(), "backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// Expire the lease as if its host had stopped renewing it
+	filename := first.leaseFilename("backup")
+	l, err := first.readLease(filename)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	l.Expires = time.Now().Add(-time.Second)
+	if err := first.writeLease(filename, l, 0); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if err := second.Acquire(context.Background(), "backup"); err != nil {
+		t.Fatalf("expected the expired lease to be taken over, got %v", err)
+	}
+	if err := first.Release("backup"); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("expected the first lease to be lost, got %v", err)
+	}
+	// The lease that took over is left in place
+	if err := second.Release("backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestLeaseLocker_Lost(t *testing.T) {
+	locker := newTestLeaseLocker(t, t.TempDir(), 150*time.Millisecond)
+
+	if locker.Lost() != nil {
+		t.Errorf("expected no loss to be signaled while no lease is held")
+	}
+	if err := locker.Acquire(context.Background(), "backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	lost := locker.Lost()
+
+	// Another host takes the lease over
+	filename := locker.leaseFilename("backup")
+	l, err := locker.readLease(filename)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	l.Token, l.Hostname = newToken(), "elsewhere"
+	if err := locker.writeLease(filename, l, os.O_TRUNC); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the lost lease to be signaled")
+	}
+	if err := locker.Release("backup"); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("expected the lease to be lost, got %v", err)
+	}
+	if locker.Lost() != nil {
+		t.Errorf("expected the loss to be cleared once no lease is held")
+	}
+}
@@ -0,0 +1,124 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+)
+
+var (
+	// ErrLockTimeout is returned by Acquire when the context deadline passes
+	// before the lock is acquired.
+	ErrLockTimeout = errors.New("timed out acquiring lock")
+	// ErrLockCanceled is returned by Acquire when the context is canceled
+	// before the lock is acquired.
+	ErrLockCanceled = errors.New("canceled while acquiring lock")
+)
+
+// contextError converts the error of a done context into ErrLockTimeout or
+// ErrLockCanceled, keeping the context error in the chain.
+func contextError(ctx context.Context, lockName string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w %s: %w", ErrLockTimeout, lockName, ctx.Err())
+	}
+	return fmt.Errorf("%w %s: %w", ErrLockCanceled, lockName, ctx.Err())
+}
+
+// Locker defines the interface for a locking mechanism
+type Locker interface {
+	// Acquire takes the lock, waiting until ctx is done. The lock is always
+	// tried at least once, so an expired ctx makes a single attempt.
+	Acquire(ctx context.Context, lockName string) error
+	Release(lockName string) error
+	// SetHolder sets the metadata recorded for locks acquired after the call.
+	SetHolder(holder Holder)
+}
+
+// Mode is how a lock is held.
+type Mode string
+
+const (
+	// ModeExclusive excludes every other holder. It is the default.
+	ModeExclusive Mode = "exclusive"
+	// ModeShared may be held by several shared holders at once, but
+	// excludes exclusive holders.
+	ModeShared Mode = "shared"
+)
+
+// LockInfo describes the state of a lock.
+type LockInfo struct {
+	Group string `json:"group"`
+	// Slot is the slot number for groups that allow several concurrent
+	// jobs, and zero otherwise.
+	Slot int  `json:"slot,omitempty"`
+	Held bool `json:"held"`
+	// Mode is how the lock is held, if it is held.
+	Mode Mode `json:"mode,omitempty"`
+	// Position is the place in the queue of a waiter for a fair group, with
+	// the next in line at 1. It is zero for the group's lock files.
+	Position int `json:"position,omitempty"`
+	// Priority is the priority of a waiter.
+	Priority int     `json:"priority,omitempty"`
+	Holder   *Holder `json:"holder,omitempty"`
+}
+
+// SharedLocker is implemented by lockers that can hold locks shared. Other
+// lockers hold every lock exclusively.
+type SharedLocker interface {
+	// SetMode sets whether locks acquired after the call are held shared or
+	// exclusively.
+	SetMode(mode Mode)
+}
+
+// Prioritizer is implemented by lockers whose waiting jobs acquire locks in
+// order of priority, highest first. Groups may configure their priority for
+// such lockers.
+type Prioritizer interface {
+	// SetPriority sets the priority of locks acquired after the call, in
+	// place of the priority configured for their groups.
+	SetPriority(priority int)
+}
+
+// Lister is implemented by lockers that can enumerate their locks.
+type Lister interface {
+	List() ([]LockInfo, error)
+}
+
+// HolderLister is implemented by lockers that can report who holds a lock.
+type HolderLister interface {
+	// Holders returns the recorded holders of a lock that is held
+	// exclusively. It may be called while Acquire is waiting for the lock.
+	Holders(lockName string) ([]Holder, error)
+}
+
+// HolderUpdater is implemented by lockers that can update the holder recorded
+// for the locks they hold.
+type HolderUpdater interface {
+	// UpdateHolder replaces the holder recorded for the locks held, keeping
+	// when each was acquired, and sets it for locks acquired after the call.
+	UpdateHolder(holder Holder) error
+}
+
+// LossNotifier is implemented by lockers whose locks can be lost while they
+// are held, such as when their session with a lock server expires.
+type LossNotifier interface {
+	// Lost returns a channel that is closed once the locks held by the
+	// locker have been lost.
+	Lost() <-chan struct{}
+}
+
+// JobLimiter is implemented by lockers that can limit how many jobs run at
+// once on the host.
+type JobLimiter interface {
+	// AcquireJobSlot takes one of the host's max_jobs job slots, waiting
+	// until ctx is done.
+	AcquireJobSlot(ctx context.Context) error
+	ReleaseJobSlot() error
+}
+
+// LockFactory creates the locker of a lock backend. Lockers that connect to a
+// lock server implement io.Closer, and are closed once no longer used.
+type LockFactory func(*config.Config, filesystem.FileSystem) (Locker, error)
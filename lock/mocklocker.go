@@ -0,0 +1,156 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+)
+
+// MockLocker provides a mock implementation of the Locker interface.
+type MockLocker struct {
+	locks              map[string]bool
+	mu                 sync.Mutex
+	AcquireFunc        func(lockName string) error             // Customizable Acquire function for mocking
+	ReleaseFunc        func(lockName string) error             // Customizable Release function for mocking
+	AcquireJobSlotFunc func() error                            // Customizable AcquireJobSlot function for mocking
+	HoldersFunc        func(lockName string) ([]Holder, error) // Customizable Holders function for mocking
+	ListFunc           func() ([]LockInfo, error)              // Customizable List function for mocking
+	JobSlotHeld        bool                                    // Whether a job slot is held
+	Holder             *Holder                                 // Last value passed to SetHolder
+	UpdatedHolder      *Holder                                 // Last value passed to UpdateHolder
+	Mode               Mode                                    // Last value passed to SetMode
+	Priority           int                                     // Last value passed to SetPriority
+	LostCh             chan struct{}                           // Channel returned by Lost
+}
+
+// NewMockLocker creates a mock Locker instance
+func NewMockLocker() *MockLocker {
+	return &MockLocker{
+		locks: make(map[string]bool),
+	}
+}
+
+// WrapFactory wraps a MockLocker in a LockFactory function
+func WrapFactory(mockLocker *MockLocker) LockFactory {
+	return func(cfg *config.Config, fs filesystem.FileSystem) (Locker, error) {
+		// Return the mockLocker wrapped as a LockFactory
+		return mockLocker, nil
+	}
+}
+
+// Acquire simulates acquiring a lock.
+// It uses the AcquireFunc for mockable behavior.
+func (ml *MockLocker) Acquire(ctx context.Context, lockName string) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if ml.AcquireFunc != nil {
+		return ml.AcquireFunc(lockName)
+	}
+
+	// Default behavior if AcquireFunc isn't set
+	if ml.locks[lockName] {
+		return fmt.Errorf("lock %s already exists", lockName)
+	}
+	ml.locks[lockName] = true
+	return nil
+}
+
+// Release simulates releasing a lock.
+// It uses the ReleaseFunc for mockable behavior.
+func (ml *MockLocker) Release(lockName string) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if ml.ReleaseFunc != nil {
+		return ml.ReleaseFunc(lockName)
+	}
+
+	// Default behavior if ReleaseFunc isn't set
+	if !ml.locks[lockName] {
+		return fmt.Errorf("lock %s does not exist", lockName)
+	}
+	delete(ml.locks, lockName)
+	return nil
+}
+
+// Holders returns the holders reported by HoldersFunc, or none. It does not
+// take the mutex, as it may be called while AcquireFunc is blocked.
+func (ml *MockLocker) Holders(lockName string) ([]Holder, error) {
+	if ml.HoldersFunc != nil {
+		return ml.HoldersFunc(lockName)
+	}
+	return nil, nil
+}
+
+// List returns the locks reported by ListFunc, or none.
+func (ml *MockLocker) List() ([]LockInfo, error) {
+	if ml.ListFunc != nil {
+		return ml.ListFunc()
+	}
+	return nil, nil
+}
+
+// Lost returns LostCh, so that a test can report the locks lost by closing
+// it.
+func (ml *MockLocker) Lost() <-chan struct{} {
+	return ml.LostCh
+}
+
+// AcquireJobSlot simulates taking a job slot.
+func (ml *MockLocker) AcquireJobSlot(ctx context.Context) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if ml.AcquireJobSlotFunc != nil {
+		if err := ml.AcquireJobSlotFunc(); err != nil {
+			return err
+		}
+	}
+	ml.JobSlotHeld = true
+	return nil
+}
+
+// ReleaseJobSlot simulates releasing a job slot.
+func (ml *MockLocker) ReleaseJobSlot() error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if !ml.JobSlotHeld {
+		return fmt.Errorf("no job slot is held")
+	}
+	ml.JobSlotHeld = false
+	return nil
+}
+
+// SetHolder records the holder metadata.
+func (ml *MockLocker) SetHolder(holder Holder) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.Holder = &holder
+}
+
+// UpdateHolder records the updated holder metadata.
+func (ml *MockLocker) UpdateHolder(holder Holder) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.UpdatedHolder = &holder
+	return nil
+}
+
+// SetPriority records the lock priority.
+func (ml *MockLocker) SetPriority(priority int) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.Priority = priority
+}
+
+// SetMode records the lock mode.
+func (ml *MockLocker) SetMode(mode Mode) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.Mode = mode
+}
@@ -0,0 +1,293 @@
+package lock
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/flock"
+)
+
+// Each group keeps a registry of the jobs waiting for it, as a queue of
+// tickets in its directory. A waiter creates a ticket file numbered one past
+// the highest in the queue, with its priority in the name, and keeps it
+// locked while it waits. Tickets are ordered by priority, highest first, and
+// then by number, and only the waiter at the front of the queue may try for
+// the group. The others block on the ticket of the waiter ahead of them, so
+// each is woken as soon as its turn may have come. A ticket whose file is no
+// longer locked belongs to a waiter that died, and is removed by whoever
+// finds it. The queue lock file is held while tickets are created or
+// removed, so that a new ticket is never mistaken for a dead one before its
+// waiter has locked it.
+
+// ticket is a waiter's place in a group's queue
+type ticket struct {
+	number   int
+	priority int
+	fileLock *flock.Flock // only set for the locker's own ticket
+}
+
+// compareTickets orders tickets by priority, highest first, then by arrival
+func compareTickets(a, b ticket) int {
+	return cmp.Or(cmp.Compare(b.priority, a.priority), cmp.Compare(a.number, b.number))
+}
+
+// queueFilename returns the path of the lock file that guards a group's
+// queue of tickets
+func (fl *FileLocker) queueFilename(lockName string) string {
+	return fl.lockFilename(lockName) + ".queue"
+}
+
+// ticketFilename returns the path of a ticket in a group's queue
+func (fl *FileLocker) ticketFilename(lockName string, t ticket) string {
+	return fmt.Sprintf("%s.ticket.%d.%d", fl.lockFilename(lockName), t.number, t.priority)
+}
+
+// parseTicket reports whether name is a ticket file, and which if it is
+func (fl *FileLocker) parseTicket(name string) (ticket, bool) {
+	suffix, ok := strings.CutPrefix(name, fl.cfg.LockFileName+".ticket.")
+	if !ok {
+		return ticket{}, false
+	}
+	number, priority, ok := strings.Cut(suffix, ".")
+	if !ok {
+		return ticket{}, false
+	}
+	var (
+		t           ticket
+		errNumber   error
+		errPriority error
+	)
+	t.number, errNumber = strconv.Atoi(number)
+	t.priority, errPriority = strconv.Atoi(priority)
+	if errNumber != nil || errPriority != nil || t.number < 1 {
+		return ticket{}, false
+	}
+	return t, true
+}
+
+// withQueue calls fn while holding the lock on the group's queue. It is only
+// held briefly, so it is waited for without a timeout
+func (fl *FileLocker) withQueue(lockName string, fn func() error) error {
+	queue := flock.New(fl.queueFilename(lockName))
+	if err := queue.Lock(); err != nil {
+		return fmt.Errorf("failed to lock queue of %s: %w", lockName, err)
+	}
+	defer queue.Close()
+	return fn()
+}
+
+// tickets returns the live tickets in a group's queue in order, removing
+// those left behind by waiters that died. It must be called with the queue
+// locked
+func (fl *FileLocker) tickets(lockName string) ([]ticket, error) {
+	files, err := fl.fs.ReadDir(filepath.Join(fl.cfg.LockDir, lockName))
+	if err != nil {
+		return nil, fmt.Errorf("error reading queue of %s: %w", lockName, err)
+	}
+
+	var tickets []ticket
+	for _, file := range files {
+		t, ok := fl.parseTicket(file.Name())
+		if !ok {
+			continue
+		}
+		filename := fl.ticketFilename(lockName, t)
+		live, err := ticketLive(filename)
+		if err != nil {
+			return nil, err
+		}
+		if !live {
+			_ = fl.fs.Remove(filename)
+			continue
+		}
+		tickets = append(tickets, t)
+	}
+	slices.SortFunc(tickets, compareTickets)
+	return tickets, nil
+}
+
+// ticketLive reports whether a ticket's waiter still holds it locked
+func ticketLive(filename string) (bool, error) {
+	probe := flock.New(filename)
+	defer probe.Close()
+
+	locked, err := probe.TryLock()
+	if err != nil {
+		return false, fmt.Errorf("failed to probe ticket %s: %w", filename, err)
+	}
+	return !locked, nil
+}
+
+// takeTicket joins a group's queue with the locker's priority, or the group's
+// if none was set
+func (fl *FileLocker) takeTicket(lockName string) (*ticket, error) {
+	priority := fl.cfg.ForGroup(lockName).Priority
+	if fl.priority != nil {
+		priority = *fl.priority
+	}
+	var t *ticket
+	err := fl.withQueue(lockName, func() error {
+		tickets, err := fl.tickets(lockName)
+		if err != nil {
+			return err
+		}
+		number := 1
+		for _, other := range tickets {
+			number = max(number, other.number+1)
+		}
+
+		t = &ticket{number: number, priority: priority}
+		filename := fl.ticketFilename(lockName, *t)
+		if fl.holder != nil {
+			// Best effort, as with the holder metadata of lock files
+			_ = writeHolder(fl.fs, filename, fl.holder)
+		}
+		t.fileLock = flock.New(filename)
+		locked, err := t.fileLock.TryLock()
+		if err != nil {
+			return fmt.Errorf("failed to lock ticket %s: %w", filename, err)
+		}
+		if !locked {
+			return fmt.Errorf("ticket %s is already locked", filename)
+		}
+		return nil
+	})
+	return t, err
+}
+
+// leaveQueue removes a ticket from its group's queue
+func (fl *FileLocker) leaveQueue(lockName string, t *ticket) error {
+	return fl.withQueue(lockName, func() error {
+		filename := fl.ticketFilename(lockName, *t)
+		// Closed before it is removed, as open files cannot be removed on
+		// Windows
+		if err := t.fileLock.Close(); err != nil {
+			return fmt.Errorf("failed to unlock ticket %s: %w", filename, err)
+		}
+		if err := fl.fs.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove ticket %s: %w", filename, err)
+		}
+		return nil
+	})
+}
+
+// ahead returns the ticket immediately ahead of t in a group's queue, or nil
+// if t is at the front
+func (fl *FileLocker) ahead(lockName string, t *ticket) (*ticket, error) {
+	var ahead *ticket
+	err := fl.withQueue(lockName, func() error {
+		tickets, err := fl.tickets(lockName)
+		if err != nil {
+			return err
+		}
+		for _, other := range tickets {
+			if compareTickets(other, *t) >= 0 {
+				break
+			}
+			ahead = &other
+		}
+		return nil
+	})
+	return ahead, err
+}
+
+// waitTurn returns once t is at the front of a group's queue, that is once
+// every waiter ahead of it has acquired the group or given up
+func (fl *FileLocker) waitTurn(ctx context.Context, lockName string, t *ticket) error {
+	for {
+		ahead, err := fl.ahead(lockName, t)
+		if err != nil || ahead == nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return contextError(ctx, lockName)
+		}
+
+		// The ticket ahead is unlocked once its waiter leaves the queue or
+		// dies. It is opened without creating it, as it may already be gone
+		aheadLock := flock.New(fl.ticketFilename(lockName, *ahead), flock.SetFlag(os.O_RDONLY))
+		if err := waitLock(ctx, aheadLock, false); err != nil {
+			if ctx.Err() != nil {
+				return contextError(ctx, lockName)
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("failed to wait for ticket %d of %s: %w", ahead.number, lockName, err)
+			}
+		}
+		_ = aheadLock.Close()
+	}
+}
+
+// lockQueued takes the group's own lock files, queueing for them if they are
+// not free or the group is fair, and returns the slot it locked
+func (fl *FileLocker) lockQueued(ctx context.Context, lockName string, filenames []string) (int, error) {
+	if !fl.cfg.ForGroup(lockName).Fair {
+		tryCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		slot, err := fl.lockFiles(tryCtx, lockName, filenames)
+		switch {
+		case err == nil:
+			return slot, nil
+		case !errors.Is(err, ErrLockCanceled):
+			return -1, err
+		case ctx.Err() != nil:
+			return -1, contextError(ctx, lockName)
+		}
+	}
+
+	t, err := fl.takeTicket(lockName)
+	if err != nil {
+		return -1, err
+	}
+	defer fl.leaveQueue(lockName, t)
+
+	for {
+		if err := fl.waitTurn(ctx, lockName, t); err != nil {
+			return -1, err
+		}
+		slot, err := fl.lockFiles(ctx, lockName, filenames)
+		if err != nil {
+			return -1, err
+		}
+
+		// A waiter with a higher priority may have joined the queue while we
+		// waited for the lock, in which case it is handed over
+		ahead, err := fl.ahead(lockName, t)
+		if err == nil && ahead == nil {
+			return slot, nil
+		}
+		_ = fl.unlockFiles(lockName, filenames, slot)
+		if err != nil {
+			return -1, err
+		}
+	}
+}
+
+// listTickets returns the waiters queued for a group, in queue order
+func (fl *FileLocker) listTickets(group string) ([]LockInfo, error) {
+	var tickets []ticket
+	err := fl.withQueue(group, func() error {
+		var err error
+		tickets, err = fl.tickets(group)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	waiters := make([]LockInfo, len(tickets))
+	for i, t := range tickets {
+		waiters[i] = LockInfo{Group: group, Position: i + 1, Priority: t.priority}
+		// Waiters that could not record themselves are still listed
+		waiters[i].Holder, _ = ReadHolder(fl.fs, fl.ticketFilename(group, t))
+	}
+	return waiters, nil
+}
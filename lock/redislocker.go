@@ -0,0 +1,386 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisLocker implements the Locker interface with keys in Redis, for hosts
+// that share no storage.
+//
+// A lock is taken with SET NX PX, so the key expires unless the holder keeps
+// renewing it. The key holds a random token along with the holder, and it is
+// only renewed or deleted by a script that first checks the token, so a
+// holder whose key expired and was taken by another host cannot release or
+// extend that host's lock. It finds out when it next renews the key: the
+// channel returned by Lost is closed, and Release returns ErrLeaseLost.
+//
+// Locks are always exclusive and groups are locked independently of their
+// subgroups. Waiting jobs poll the key, so priorities are not honoured.
+type RedisLocker struct {
+	cfg      *config.Config
+	settings RedisConfig
+	client   *redis.Client
+	hostname string
+	locks    map[string]*heldRedisLock // keyed by lock name
+	holder   *Holder
+	lost     lossSignal
+}
+
+// RedisConfig configures the redis lock backend. It is read from the redis
+// table of the configuration.
+type RedisConfig struct {
+	// Address is the host:port of the Redis server.
+	Address  string `toml:"address"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	DB       int    `toml:"db"`
+	// KeyPrefix is prepended to the keys of the locks, so that several
+	// deployments can share a server.
+	KeyPrefix string `toml:"key_prefix"`
+	// LeaseDuration is how long a lock is held without being renewed. It is
+	// renewed three times per duration while the lock is held.
+	LeaseDuration config.Duration `toml:"lease_duration"`
+	// PollInterval is how often a waiting job tries for the lock.
+	PollInterval config.Duration `toml:"poll_interval"`
+}
+
+// DefaultRedisConfig holds the settings of the redis backend that the
+// configuration does not set.
+var DefaultRedisConfig = RedisConfig{
+	Address:       "localhost:6379",
+	KeyPrefix:     "jobwrapper:",
+	LeaseDuration: config.Duration(30 * time.Second),
+	PollInterval:  config.Duration(time.Second),
+}
+
+// redisLock is the value of a lock's key
+type redisLock struct {
+	// Token identifies the acquisition that took the lock.
+	Token    string  `json:"token"`
+	Hostname string  `json:"hostname"`
+	Holder   *Holder `json:"holder,omitempty"`
+}
+
+// heldRedisLock is a lock held by a RedisLocker
+type heldRedisLock struct {
+	// mu serializes the renewer with updates of the value
+	mu      sync.Mutex
+	value   string
+	lock    redisLock
+	renewer *renewer
+	// renewed is when the key's expiry was last set, as of the request
+	// that set it
+	renewed time.Time
+}
+
+// renewScript extends the expiry of a lock's key if it still holds our value
+var renewScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// updateScript replaces the value of a lock's key, keeping its expiry, if it
+// still holds our previous value
+var updateScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	redis.call("set", KEYS[1], ARGV[2], "KEEPTTL")
+	return 1
+end
+return 0
+`)
+
+// releaseScript deletes a lock's key if it still holds our value
+var releaseScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// NewRedisLocker creates a new RedisLocker for the server in the redis
+// configuration. The server is not contacted until a lock is taken
+func NewRedisLocker(cfg *config.Config, fs filesystem.FileSystem) (Locker, error) {
+	settings := DefaultRedisConfig
+	if err := cfg.Section("redis", &settings); err != nil {
+		return nil, err
+	}
+	if settings.Address == "" {
+		return nil, fmt.Errorf("%w: redis.address: must be set", config.ErrConfigInvalid)
+	}
+	if settings.LeaseDuration <= 0 {
+		return nil, fmt.Errorf("%w: redis.lease_duration: must be positive", config.ErrConfigInvalid)
+	}
+	if settings.PollInterval <= 0 {
+		return nil, fmt.Errorf("%w: redis.poll_interval: must be positive", config.ErrConfigInvalid)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("error getting hostname: %w", err)
+	}
+	return &RedisLocker{
+		cfg:      cfg,
+		settings: settings,
+		client: redis.NewClient(&redis.Options{
+			Addr:     settings.Address,
+			Username: settings.Username,
+			Password: settings.Password,
+			DB:       settings.DB,
+		}),
+		hostname: hostname,
+		locks:    make(map[string]*heldRedisLock),
+	}, nil
+}
+
+// requestContext returns a context bounding a single command, which must
+// complete well within a lease. It keeps the values of ctx but not its
+// cancellation, so that an expired ctx still makes a single attempt
+func (rl *RedisLocker) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), time.Duration(rl.settings.LeaseDuration)/3)
+}
+
+// lockKey returns the key of a group's lock
+func (rl *RedisLocker) lockKey(lockName string) string {
+	return rl.settings.KeyPrefix + "lock:" + lockName
+}
+
+// Acquire sets the group's key, polling until it is free or ctx is done, and
+// starts renewing it
+func (rl *RedisLocker) Acquire(ctx context.Context, lockName string) error {
+	if err := ValidateGroup(lockName); err != nil {
+		return err
+	}
+	if rl.cfg.ForGroup(lockName).MaxConcurrency > 1 {
+		return fmt.Errorf("lock %s allows several concurrent jobs, which the redis backend does not support", lockName)
+	}
+	if _, ok := rl.locks[lockName]; ok {
+		return fmt.Errorf("lock %s is already held", lockName)
+	}
+
+	lock := redisLock{Token: newToken(), Hostname: rl.hostname}
+	if rl.holder != nil {
+		holder := *rl.holder
+		holder.Acquired = time.Now()
+		lock.Holder = &holder
+	}
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	value := string(data)
+
+	leaseDuration := time.Duration(rl.settings.LeaseDuration)
+	var sent time.Time
+	for {
+		sent = time.Now()
+		reqCtx, cancel := rl.requestContext(ctx)
+		taken, err := rl.client.SetNX(reqCtx, rl.lockKey(lockName), value, leaseDuration).Result()
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to acquire lock %s: %w", lockName, err)
+		}
+		if taken {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return contextError(ctx, lockName)
+		case <-time.After(time.Duration(rl.settings.PollInterval)):
+		}
+	}
+
+	rl.lost.open()
+	held := &heldRedisLock{value: value, lock: lock, renewed: sent}
+	held.renewer = startRenewer(leaseDuration/3, func() error {
+		return rl.renew(lockName, held)
+	}, rl.lost.lose)
+	rl.locks[lockName] = held
+	return nil
+}
+
+// renew extends the expiry of a held lock's key, unless it has been taken
+// over.
+//
+// A key that cannot be renewed because the server is unreachable or failing
+// expires all the same, and may then be taken by another host. So once the
+// key has gone five sixths of a lease without being renewed, or the next
+// attempt a third of a lease later would come after that, the lock is given
+// up as lost rather than renewed
+func (rl *RedisLocker) renew(lockName string, held *heldRedisLock) error {
+	held.mu.Lock()
+	defer held.mu.Unlock()
+	leaseDuration := time.Duration(rl.settings.LeaseDuration)
+	if time.Since(held.renewed) >= leaseDuration*5/6 {
+		return fmt.Errorf("%w for %s: key expired before it could be renewed", ErrLeaseLost, lockName)
+	}
+
+	sent := time.Now()
+	ctx, cancel := rl.requestContext(context.Background())
+	defer cancel()
+	renewed, err := renewScript.Run(ctx, rl.client, []string{rl.lockKey(lockName)},
+		held.value, leaseDuration.Milliseconds()).Int()
+	if err != nil {
+		if time.Since(held.renewed)+leaseDuration/3 >= leaseDuration*5/6 {
+			return fmt.Errorf("%w for %s: key about to expire: %w", ErrLeaseLost, lockName, err)
+		}
+		return err
+	}
+	if renewed == 0 {
+		return fmt.Errorf("%w for %s: key expired", ErrLeaseLost, lockName)
+	}
+	held.renewed = sent
+	return nil
+}
+
+// Release stops renewing the group's key and deletes it, unless it has been
+// lost to another host, in which case ErrLeaseLost is returned
+func (rl *RedisLocker) Release(lockName string) error {
+	held, ok := rl.locks[lockName]
+	if !ok {
+		return fmt.Errorf("lock %s is not held", lockName)
+	}
+	delete(rl.locks, lockName)
+	if len(rl.locks) == 0 {
+		defer rl.lost.reset()
+	}
+	if err := held.renewer.Stop(); err != nil {
+		return err
+	}
+
+	ctx, cancel := rl.requestContext(context.Background())
+	defer cancel()
+	deleted, err := releaseScript.Run(ctx, rl.client, []string{rl.lockKey(lockName)}, held.value).Int()
+	if err != nil {
+		return fmt.Errorf("failed to release lock %s: %w", lockName, err)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("%w for %s: key expired", ErrLeaseLost, lockName)
+	}
+	return nil
+}
+
+// Lost returns a channel that is closed once a lock held by the locker is
+// found to have expired when renewing it. It never closes while no lock is
+// held
+func (rl *RedisLocker) Lost() <-chan struct{} {
+	return rl.lost.channel()
+}
+
+// Close closes the connection to the server. Locks still held are left to
+// expire
+func (rl *RedisLocker) Close() error {
+	for _, held := range rl.locks {
+		_ = held.renewer.Stop()
+	}
+	return rl.client.Close()
+}
+
+// SetHolder sets the metadata recorded in locks taken after the call
+func (rl *RedisLocker) SetHolder(holder Holder) {
+	rl.holder = &holder
+}
+
+// UpdateHolder records the holder anew in the key of each lock held, and sets
+// it for locks acquired after the call
+func (rl *RedisLocker) UpdateHolder(holder Holder) error {
+	rl.holder = &holder
+	var errs []error
+	for lockName, held := range rl.locks {
+		if err := rl.updateHolder(lockName, held, holder); err != nil {
+			errs = append(errs, fmt.Errorf("failed to update the holder of lock %s: %w", lockName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// updateHolder replaces the holder recorded in a held lock's key
+func (rl *RedisLocker) updateHolder(lockName string, held *heldRedisLock, holder Holder) error {
+	held.mu.Lock()
+	defer held.mu.Unlock()
+	ctx, cancel := rl.requestContext(context.Background())
+	defer cancel()
+	lock := held.lock
+	updated := updatedHolder(holder, lock.Holder)
+	lock.Holder = &updated
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	replaced, err := updateScript.Run(ctx, rl.client, []string{rl.lockKey(lockName)}, held.value, string(data)).Int()
+	if err != nil {
+		return err
+	}
+	if replaced == 0 {
+		return fmt.Errorf("%w for %s: key expired", ErrLeaseLost, lockName)
+	}
+	held.value, held.lock = string(data), lock
+	return nil
+}
+
+// List reports every held lock. Free locks have no key, so they are not
+// listed
+func (rl *RedisLocker) List() ([]LockInfo, error) {
+	ctx, cancel := rl.requestContext(context.Background())
+	defer cancel()
+	prefix := rl.lockKey("")
+
+	var locks []LockInfo
+	iter := rl.client.Scan(ctx, 0, prefix+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		group := strings.TrimPrefix(iter.Val(), prefix)
+		info := LockInfo{Group: group, Held: true, Mode: ModeExclusive}
+		// A lock released since it was scanned is still listed, without
+		// its holder
+		if lock, err := rl.readLock(group); err == nil {
+			info.Holder = lock.Holder
+		}
+		locks = append(locks, info)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("error listing locks: %w", err)
+	}
+	return locks, nil
+}
+
+// Holders returns the holder recorded in the group's key, unless it is free
+func (rl *RedisLocker) Holders(lockName string) ([]Holder, error) {
+	lock, err := rl.readLock(lockName)
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lock.Holder == nil {
+		return nil, nil
+	}
+	return []Holder{*lock.Holder}, nil
+}
+
+// readLock reads the value of a group's key, returning redis.Nil if it is
+// free
+func (rl *RedisLocker) readLock(lockName string) (redisLock, error) {
+	var lock redisLock
+	ctx, cancel := rl.requestContext(context.Background())
+	defer cancel()
+	data, err := rl.client.Get(ctx, rl.lockKey(lockName)).Bytes()
+	if err != nil {
+		return lock, err
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return lock, fmt.Errorf("invalid lock holder in %s: %w", rl.lockKey(lockName), err)
+	}
+	return lock, nil
+}
@@ -0,0 +1,184 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+)
+
+func newTestRedisLocker(t *testing.T, server *miniredis.Miniredis, leaseDuration time.Duration) *RedisLocker {
+	t.Helper()
+	cfg := &config.Config{
+		LockBackend: "redis",
+	}
+	if err := cfg.SetSection("redis", RedisConfig{
+		Address:       server.Addr(),
+		KeyPrefix:     "jobwrapper:",
+		LeaseDuration: config.Duration(leaseDuration),
+		PollInterval:  config.Duration(10 * time.Millisecond),
+	}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	locker, err := NewLocker(cfg, filesystem.OSFileSystem{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	t.Cleanup(func() { locker.(*RedisLocker).Close() })
+	return locker.(*RedisLocker)
+}
+
+func TestRedisLocker_Exclusive(t *testing.T) {
+	server := miniredis.RunT(t)
+	first := newTestRedisLocker(t, server, time.Minute)
+	second := newTestRedisLocker(t, server, time.Minute)
+	first.SetHolder(NewHolder("run1", []string{"/bin/backup"}))
+
+	if err := first.Acquire(context.Background(), "db/backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := second.Acquire(ctx, "db/backup"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expected a lock timeout, got %v", err)
+	}
+
+	holders, err := second.Holders("db/backup")
+	if err != nil || len(holders) != 1 || holders[0].RunID != "run1" {
+		t.Errorf("expected run1 to hold the lock, got %v, %v", holders, err)
+	}
+	locks, err := second.List()
+	if err != nil || len(locks) != 1 || locks[0].Group != "db/backup" || locks[0].Holder == nil {
+		t.Errorf("expected db/backup to be listed with its holder, got %+v, %v", locks, err)
+	}
+
+	if err := first.Release("db/backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := second.Acquire(context.Background(), "db/backup"); err != nil {
+		t.Fatalf("expected the released lock to be taken, got %v", err)
+	}
+	if err := second.Release("db/backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestRedisLocker_Renewal(t *testing.T) {
+	server := miniredis.RunT(t)
+	locker := newTestRedisLocker(t, server, 300*time.Millisecond)
+
+	if err := locker.Acquire(context.Background(), "backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// miniredis only expires keys when its clock is moved on
+	server.FastForward(250 * time.Millisecond)
+	time.Sleep(250 * time.Millisecond)
+	if ttl := server.TTL(locker.lockKey("backup")); ttl <= 100*time.Millisecond {
+		t.Errorf("expected the lease to be renewed, got a TTL of %s", ttl)
+	}
+	if err := locker.Release("backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestRedisLocker_UpdateHolder(t *testing.T) {
+	server := miniredis.RunT(t)
+	locker := newTestRedisLocker(t, server, 300*time.Millisecond)
+	holder := NewHolder("run1", []string{"/bin/backup"})
+	locker.SetHolder(holder)
+
+	if err := locker.Acquire(context.Background(), "backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	holder.PGID = 4242
+	if err := locker.UpdateHolder(holder); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	holders, err := locker.Holders("backup")
+	if err != nil || len(holders) != 1 || holders[0].PGID != 4242 || holders[0].Acquired.IsZero() {
+		t.Errorf("expected the process group to be recorded, got %+v, %v", holders, err)
+	}
+
+	// The updated key is still renewed and released as ours
+	server.FastForward(250 * time.Millisecond)
+	time.Sleep(250 * time.Millisecond)
+	if ttl := server.TTL(locker.lockKey("backup")); ttl <= 100*time.Millisecond {
+		t.Errorf("expected the lease to be renewed, got a TTL of %s", ttl)
+	}
+	if err := locker.Release("backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestRedisLocker_TakesOverExpiredLock(t *testing.T) {
+	server := miniredis.RunT(t)
+	first := newTestRedisLocker(t, server, time.Minute)
+	second := newTestRedisLocker(t, server, time.Minute)
+
+	if err := first.Acquire(context.Background(), "backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	server.FastForward(2 * time.Minute)
+
+	if err := second.Acquire(context.Background(), "backup"); err != nil {
+		t.Fatalf("expected the expired lock to be taken over, got %v", err)
+	}
+	if err := first.Release("backup"); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("expected the first lock to be lost, got %v", err)
+	}
+	// The lock that took over is left in place
+	if err := second.Release("backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestRedisLocker_Lost(t *testing.T) {
+	server := miniredis.RunT(t)
+	locker := newTestRedisLocker(t, server, 300*time.Millisecond)
+
+	if err := locker.Acquire(context.Background(), "backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	lost := locker.Lost()
+
+	// The key expires and is taken by another host
+	server.Set(locker.lockKey("backup"), `{"token":"other","hostname":"elsewhere"}`)
+
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the lost lock to be signaled")
+	}
+	if err := locker.Release("backup"); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("expected the lock to be lost, got %v", err)
+	}
+	if locker.Lost() != nil {
+		t.Errorf("expected the loss to be cleared once no lock is held")
+	}
+}
+
+func TestRedisLocker_LostWhileUnreachable(t *testing.T) {
+	server := miniredis.RunT(t)
+	locker := newTestRedisLocker(t, server, 300*time.Millisecond)
+
+	if err := locker.Acquire(context.Background(), "backup"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	lost := locker.Lost()
+
+	// Every renewal fails, so the key would expire unnoticed
+	server.SetError("server unavailable")
+
+	select {
+	case <-lost:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the lock to be given up before its key expired")
+	}
+	if err := locker.Release("backup"); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("expected the lock to be lost, got %v", err)
+	}
+}
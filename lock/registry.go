@@ -0,0 +1,61 @@
+package lock
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+)
+
+// DefaultBackend is the lock backend used when lock_backend is not set.
+const DefaultBackend = "file"
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]LockFactory{
+		"file":      NewFileLocker,
+		"nfs-lease": NewLeaseLocker,
+		"redis":     NewRedisLocker,
+		"etcd":      NewEtcdLocker,
+	}
+)
+
+// Register makes a lock backend available under name, so that it can be
+// selected with lock_backend. A backend with settings of its own reads them
+// from its config.Config.Section. Register panics if name is already taken,
+// as it is meant to be called from init functions.
+func Register(name string, factory LockFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if _, ok := backends[name]; ok {
+		panic(fmt.Sprintf("lock backend %q registered twice", name))
+	}
+	backends[name] = factory
+}
+
+// Backends returns the names of the registered lock backends, sorted.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	return slices.Sorted(maps.Keys(backends))
+}
+
+// NewLocker creates the locker of the backend selected by lock_backend.
+func NewLocker(cfg *config.Config, fs filesystem.FileSystem) (Locker, error) {
+	name := cfg.LockBackend
+	if name == "" {
+		name = DefaultBackend
+	}
+	backendsMu.RLock()
+	factory, ok := backends[name]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: lock_backend: unknown backend %q, expected one of %s",
+			config.ErrConfigInvalid, name, strings.Join(Backends(), ", "))
+	}
+	return factory(cfg, fs)
+}
@@ -0,0 +1,74 @@
+package lock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+)
+
+func TestNewLocker(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if err := os.Mkdir(filepath.Join(home, ".jobwrapper"), 0755); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	conf := "lock_backend = \"registry-test\"\n\n[registry-test]\nname = \"custom\"\n\n[redis]\npoll_interval = \"0s\"\n"
+	if err := os.WriteFile(filepath.Join(home, ".jobwrapper", "jobwrapper.conf"), []byte(conf), 0644); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	type testSettings struct {
+		Name  string `toml:"name"`
+		Retry int    `toml:"retry"`
+	}
+	var settings testSettings
+	Register("registry-test", func(cfg *config.Config, fs filesystem.FileSystem) (Locker, error) {
+		settings = testSettings{Retry: 3}
+		if err := cfg.Section("registry-test", &settings); err != nil {
+			return nil, err
+		}
+		return &MockLocker{}, nil
+	})
+	if !slices.Contains(Backends(), "registry-test") {
+		t.Fatalf("expected registry-test to be registered, got %v", Backends())
+	}
+
+	cfg, err := config.LoadConfig(filesystem.OSFileSystem{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	locker, err := NewLocker(&cfg, filesystem.OSFileSystem{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, ok := locker.(*MockLocker); !ok {
+		t.Errorf("expected the registered backend, got %T", locker)
+	}
+	// Settings the subsection leaves out keep their defaults
+	if settings != (testSettings{Name: "custom", Retry: 3}) {
+		t.Errorf("expected the backend's subsection to be decoded, got %+v", settings)
+	}
+
+	cfg.LockBackend = ""
+	if locker, err := NewLocker(&cfg, filesystem.OSFileSystem{}); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	} else if _, ok := locker.(*FileLocker); !ok {
+		t.Errorf("expected the file backend by default, got %T", locker)
+	}
+
+	// The built-in backends read their own subsections too
+	cfg.LockBackend = "redis"
+	if _, err := NewLocker(&cfg, filesystem.OSFileSystem{}); !errors.Is(err, config.ErrConfigInvalid) {
+		t.Errorf("expected the redis subsection to be rejected, got %v", err)
+	}
+
+	cfg.LockBackend = "bogus"
+	if _, err := NewLocker(&cfg, filesystem.OSFileSystem{}); !errors.Is(err, config.ErrConfigInvalid) {
+		t.Errorf("expected an invalid config error, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package lock
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrLeaseLost is returned by Release when the lease behind a lock expired
+// while it was held and was taken over by another host.
+var ErrLeaseLost = errors.New("lease lost")
+
+// renewer renews a lease in the background while its lock is held
+type renewer struct {
+	stop chan struct{}
+	done chan struct{}
+	err  error // set once the lease is lost, read after done is closed
+}
+
+// startRenewer calls renew every interval until the renewer is stopped or
+// renew returns ErrLeaseLost, in which case lost is called. Other failures
+// are retried on the next tick, while the lease has not yet expired.
+func startRenewer(interval time.Duration, renew func() error, lost func()) *renewer {
+	r := &renewer{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+			if err := renew(); errors.Is(err, ErrLeaseLost) {
+				r.err = err
+				lost()
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// Stop stops renewing the lease, and returns the error it was lost with, if
+// it was.
+func (r *renewer) Stop() error {
+	close(r.stop)
+	<-r.done
+	return r.err
+}
+
+// lossSignal is the channel a locker whose leases are renewed returns from
+// Lost. It is opened when the first lease is taken, closed once any lease is
+// lost, and dropped once no lease is held, so that locks taken afterwards
+// start with a fresh channel.
+type lossSignal struct {
+	mu     sync.Mutex
+	ch     chan struct{}
+	closed bool
+}
+
+// channel returns the channel, or nil while no lease is held
+func (ls *lossSignal) channel() <-chan struct{} {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.ch
+}
+
+// open makes sure there is a channel for a lease that is taken
+func (ls *lossSignal) open() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.ch == nil {
+		ls.ch, ls.closed = make(chan struct{}), false
+	}
+}
+
+// lose closes the channel, as a lease was lost
+func (ls *lossSignal) lose() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.ch != nil && !ls.closed {
+		close(ls.ch)
+		ls.closed = true
+	}
+}
+
+// reset drops the channel once no lease is held
+func (ls *lossSignal) reset() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.ch = nil
+}
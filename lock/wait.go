@@ -0,0 +1,97 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// slotPollInterval is how often a job waiting for one of several slots tries
+// them again.
+const slotPollInterval = 100 * time.Millisecond
+
+// lockAny locks the first free of the given lock files and returns its index.
+// Each file is tried in order until one is free or ctx is done. A single file
+// is waited for by blocking on it, so a waiter gets the lock as soon as it is
+// released, while several are tried again every slotPollInterval, so that no
+// wait is left blocked on a slot once another one is locked
+func (fl *FileLocker) lockAny(ctx context.Context, lockName string, filenames []string, shared bool) (int, error) {
+	for {
+		for i, filename := range filenames {
+			fileLock := fl.fileLock(filename)
+			try := fileLock.TryLock
+			if shared {
+				try = fileLock.TryRLock
+			}
+			locked, err := try()
+			if err != nil {
+				return -1, fmt.Errorf("failed to acquire lock %s: %w", lockName, err)
+			}
+			if locked {
+				return i, nil
+			}
+		}
+		if ctx.Err() != nil {
+			return -1, contextError(ctx, lockName)
+		}
+		if len(filenames) == 1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return -1, contextError(ctx, lockName)
+		case <-time.After(slotPollInterval):
+		}
+	}
+
+	// The blocked wait may outlive this call, so it uses its own flock rather
+	// than the cached one
+	fileLock := flock.New(filenames[0])
+	if err := waitLock(ctx, fileLock, shared); err != nil {
+		if ctx.Err() != nil {
+			return -1, contextError(ctx, lockName)
+		}
+		return -1, fmt.Errorf("failed to acquire lock %s: %w", lockName, err)
+	}
+	// The cached flock was left unlocked by the failed try, so it is simply
+	// replaced by the one now holding the lock
+	fl.fileLocks[filenames[0]] = fileLock
+	return 0, nil
+}
+
+// lockOne locks a single lock file, blocking until it is free or ctx is done
+func (fl *FileLocker) lockOne(ctx context.Context, lockName, filename string, shared bool) error {
+	_, err := fl.lockAny(ctx, lockName, []string{filename}, shared)
+	return err
+}
+
+// waitLock blocks until fileLock is locked or ctx is done. A blocking flock
+// cannot be interrupted, so it waits in a goroutine. If ctx is done first that
+// goroutine is left blocked until the file is unlocked or the process exits,
+// and then unlocks the file straight away. Until then the file may briefly
+// appear locked to others trying it, which only a waiter that gave up while
+// the process lives on can cause
+func waitLock(ctx context.Context, fileLock *flock.Flock, shared bool) error {
+	lock := fileLock.Lock
+	if shared {
+		lock = fileLock.RLock
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- lock()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		go func() {
+			if err := <-result; err == nil {
+				_ = fileLock.Close()
+			}
+		}()
+		return ctx.Err()
+	}
+}
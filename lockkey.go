@@ -0,0 +1,96 @@
+package jobwrapper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/lock"
+)
+
+// lockKeys returns the names the groups are locked under, in lock order, and
+// the configuration to lock them with, in which each name has the settings of
+// its group. Each is rendered from the group's lock_key template if it has one,
+// and from the group itself otherwise, so that a group such as "sync-{arg1}"
+// is locked per argument.
+func lockKeys(cfg config.Config, groups []string, args []string, lookupEnv func(string) (string, bool)) ([]string, config.Config, error) {
+	keys := make([]string, 0, len(groups))
+	lockCfg := cfg
+	lockCfg.Groups = maps.Clone(cfg.Groups)
+	for _, group := range groups {
+		template := group
+		gc, configured := cfg.Groups[group]
+		if configured && gc.LockKey != "" {
+			template = gc.LockKey
+		}
+		key, err := renderLockKey(template, args, lookupEnv)
+		if err != nil {
+			return nil, cfg, fmt.Errorf("lock key for group '%s': %w", group, err)
+		}
+		if err := lock.ValidateGroup(key); err != nil {
+			return nil, cfg, fmt.Errorf("lock key for group '%s': %w", group, err)
+		}
+		if configured && key != group {
+			lockCfg.Groups[key] = gc
+		}
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, lock.CompareGroups)
+	return slices.Compact(keys), lockCfg, nil
+}
+
+// renderLockKey expands the placeholders of a lock key template:
+//
+//	{argN}       the script's Nth argument, counting from 1
+//	{args_hash}  a short hash of all of the script's arguments
+//	{env:NAME}   the environment variable NAME
+func renderLockKey(template string, args []string, lookupEnv func(string) (string, bool)) (string, error) {
+	var key strings.Builder
+	for {
+		before, rest, found := strings.Cut(template, "{")
+		key.WriteString(before)
+		if !found {
+			return key.String(), nil
+		}
+		placeholder, after, found := strings.Cut(rest, "}")
+		if !found {
+			return "", fmt.Errorf("unterminated placeholder in %q", template)
+		}
+		value, err := expandPlaceholder(placeholder, args, lookupEnv)
+		if err != nil {
+			return "", err
+		}
+		key.WriteString(value)
+		template = after
+	}
+}
+
+// expandPlaceholder returns the value of a single lock key placeholder.
+func expandPlaceholder(placeholder string, args []string, lookupEnv func(string) (string, bool)) (string, error) {
+	if placeholder == "args_hash" {
+		sum := sha256.Sum256([]byte(strings.Join(args, "\x00")))
+		return hex.EncodeToString(sum[:6]), nil
+	}
+	if name, ok := strings.CutPrefix(placeholder, "env:"); ok {
+		value, ok := lookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	}
+	if n, ok := strings.CutPrefix(placeholder, "arg"); ok {
+		i, err := strconv.Atoi(n)
+		if err == nil && i >= 1 {
+			if i > len(args) {
+				return "", fmt.Errorf("{%s} refers to a missing argument", placeholder)
+			}
+			return args[i-1], nil
+		}
+	}
+	return "", fmt.Errorf("unknown placeholder {%s}", placeholder)
+}
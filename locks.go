@@ -0,0 +1,108 @@
+package jobwrapper
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/filesystem"
+	"github.com/jacobalberty/jobwrapper/lock"
+)
+
+// runLocks implements `jobwrapper locks`, which lists the groups in the lock
+// directory and who holds them.
+func runLocks(args []string, stdout io.Writer, stderr io.Writer, fs filesystem.FileSystem, lockFactory lock.LockFactory) error {
+	flags := flag.NewFlagSet("locks", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	asJSON := flags.Bool("json", false, "output as JSON")
+	if err := flags.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	// A job in a group named locks would otherwise silently list the locks
+	// instead of running
+	if flags.NArg() > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("unexpected argument %q, as a group cannot be named %q\n%s", flags.Arg(0), reservedGroup, usage))
+	}
+
+	cfg, err := config.LoadConfig(fs)
+	if err != nil {
+		return err
+	}
+
+	locker, err := lockFactory(&cfg, fs)
+	if err != nil {
+		return err
+	}
+	if closer, ok := locker.(io.Closer); ok {
+		defer closer.Close()
+	}
+	lister, ok := locker.(lock.Lister)
+	if !ok {
+		return fmt.Errorf("the lock backend does not support listing locks")
+	}
+	locks, err := lister.List()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		if locks == nil {
+			locks = []lock.LockInfo{}
+		}
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(locks)
+	}
+	return writeLockTable(stdout, locks, time.Now())
+}
+
+// writeLockTable writes locks as a table, with ages relative to now.
+func writeLockTable(w io.Writer, locks []lock.LockInfo, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tHELD\tPID\tHOST\tAGE\tHELD FOR\tCOMMAND")
+	for _, l := range locks {
+		group := l.Group
+		if l.Slot > 0 {
+			group = fmt.Sprintf("%s[%d]", l.Group, l.Slot)
+		}
+		if l.Holder == nil {
+			fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\t-\t-\n", group, held(l))
+			continue
+		}
+		heldFor := "-"
+		if !l.Holder.Acquired.IsZero() {
+			heldFor = now.Sub(l.Holder.Acquired).Round(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			group,
+			held(l),
+			l.Holder.PID,
+			l.Holder.Hostname,
+			now.Sub(l.Holder.Started).Round(time.Second),
+			heldFor,
+			strings.Join(l.Holder.Command, " "),
+		)
+	}
+	return tw.Flush()
+}
+
+// held describes whether a lock is held, and how, or a waiter's place in the
+// queue of a fair group.
+func held(l lock.LockInfo) string {
+	switch {
+	case l.Position > 0 && l.Priority != 0:
+		return fmt.Sprintf("queued #%d (priority %d)", l.Position, l.Priority)
+	case l.Position > 0:
+		return fmt.Sprintf("queued #%d", l.Position)
+	case !l.Held:
+		return "no"
+	case l.Mode == lock.ModeShared:
+		return "shared"
+	}
+	return "yes"
+}
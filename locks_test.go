@@ -0,0 +1,129 @@
+package jobwrapper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/lock"
+)
+
+// testLocks returns the locks of a busy host: a held group, a group with two
+// slots, a waiter queued for it and a group held shared
+func testLocks(now time.Time) []lock.LockInfo {
+	holder := &lock.Holder{
+		PID:      4242,
+		Hostname: "node1",
+		Command:  []string{"/mock/backup.sh", "--full"},
+		RunID:    "0123456789abcdef",
+		Started:  now.Add(-90 * time.Minute),
+		Acquired: now.Add(-time.Hour),
+	}
+	waiter := &lock.Holder{
+		PID:      4343,
+		Hostname: "node1",
+		Command:  []string{"/mock/thumbs.sh"},
+		Started:  now.Add(-5 * time.Minute),
+	}
+	return []lock.LockInfo{
+		{Group: "backup", Held: true, Mode: lock.ModeExclusive, Holder: holder},
+		{Group: "thumbs", Slot: 1, Held: true, Mode: lock.ModeExclusive, Holder: holder},
+		{Group: "thumbs", Slot: 2},
+		{Group: "thumbs", Position: 1, Priority: 10, Holder: waiter},
+		{Group: "db", Held: true, Mode: lock.ModeShared},
+	}
+}
+
+func TestWriteLockTable(t *testing.T) {
+	now := time.Now()
+	out := &bytes.Buffer{}
+	if err := writeLockTable(out, testLocks(now), now); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	expected := [][]string{
+		{"GROUP", "HELD", "PID", "HOST", "AGE", "HELD", "FOR", "COMMAND"},
+		{"backup", "yes", "4242", "node1", "1h30m0s", "1h0m0s", "/mock/backup.sh", "--full"},
+		{"thumbs[1]", "yes", "4242", "node1", "1h30m0s", "1h0m0s", "/mock/backup.sh", "--full"},
+		{"thumbs[2]", "no", "-", "-", "-", "-", "-"},
+		// A waiter has not acquired the lock, so it has not held it
+		{"thumbs", "queued", "#1", "(priority", "10)", "4343", "node1", "5m0s", "-", "/mock/thumbs.sh"},
+		{"db", "shared", "-", "-", "-", "-", "-"},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %q", len(expected), out.String())
+	}
+	for i, line := range lines {
+		if fields := strings.Fields(line); !reflect.DeepEqual(fields, expected[i]) {
+			t.Errorf("Expected line %d to be %q, got %q", i, expected[i], fields)
+		}
+	}
+}
+
+func TestRunLocks(t *testing.T) {
+	now := time.Now()
+	mockLocker := lock.NewMockLocker()
+	mockLocker.ListFunc = func() ([]lock.LockInfo, error) {
+		return testLocks(now), nil
+	}
+	mocks := testSetup(t, nil, mockLocker, nil)
+
+	t.Run("Table", func(t *testing.T) {
+		stdout := &bytes.Buffer{}
+		if err := run(context.Background(), []string{"locks"}, stdout, &bytes.Buffer{}, mocks.FileSystem, mocks.Locker, mocks.CommandContext); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !strings.HasPrefix(stdout.String(), "GROUP") || !strings.Contains(stdout.String(), "queued #1 (priority 10)") {
+			t.Errorf("Expected a table of the locks, got %q", stdout.String())
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		stdout := &bytes.Buffer{}
+		if err := run(context.Background(), []string{"locks", "--json"}, stdout, &bytes.Buffer{}, mocks.FileSystem, mocks.Locker, mocks.CommandContext); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		var locks []lock.LockInfo
+		if err := json.Unmarshal(stdout.Bytes(), &locks); err != nil {
+			t.Fatalf("Expected JSON, got %q: %v", stdout.String(), err)
+		}
+		if len(locks) != 5 || locks[0].Holder == nil || locks[0].Holder.RunID != "0123456789abcdef" || locks[3].Position != 1 || locks[4].Mode != lock.ModeShared {
+			t.Errorf("Expected the locks to round trip, got %+v", locks)
+		}
+	})
+
+	t.Run("Empty JSON", func(t *testing.T) {
+		mocks := testSetup(t, nil, nil, nil)
+		stdout := &bytes.Buffer{}
+		if err := run(context.Background(), []string{"locks", "--json"}, stdout, &bytes.Buffer{}, mocks.FileSystem, mocks.Locker, mocks.CommandContext); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if strings.TrimSpace(stdout.String()) != "[]" {
+			t.Errorf("Expected an empty JSON array, got %q", stdout.String())
+		}
+	})
+
+	t.Run("Extra Arguments", func(t *testing.T) {
+		// Such as a job in a group named locks
+		err := run(context.Background(), []string{"locks", "/mock/script.sh"}, &bytes.Buffer{}, &bytes.Buffer{}, mocks.FileSystem, mocks.Locker, mocks.CommandContext)
+		if code := ExitCode(err); code != exitUsage {
+			t.Errorf("Expected exit code %d, got %d (%v)", exitUsage, code, err)
+		}
+	})
+}
+
+func TestParseArgs_ReservedGroup(t *testing.T) {
+	for _, args := range [][]string{
+		{"--group", "locks", "/script.sh"},
+		{"backup,locks", "/script.sh"},
+	} {
+		if _, err := parseArgs(args, &bytes.Buffer{}); ExitCode(err) != exitUsage {
+			t.Errorf("parseArgs(%q): expected a usage error, got %v", args, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package jobwrapper
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jacobalberty/jobwrapper/lock"
+)
+
+const usage = `usage: jobwrapper [options] <group>[,<group>...] <script> [args...]
+       jobwrapper [options] --group <group> [--group <group>...] <script> [args...]
+       jobwrapper locks [--json]`
+
+// reservedGroup is the subcommand that lists locks, which therefore cannot
+// name a group.
+const reservedGroup = "locks"
+
+// options holds the command line of a job invocation.
+type options struct {
+	noWait bool
+	mode   lock.Mode
+	// priority overrides the configured priority when set
+	priority *int
+	groups   []string
+	cmd      string
+	cmdArgs  []string
+}
+
+// parseArgs parses the command line of a job invocation. Options must come
+// before the group so that the script's own arguments are passed through
+// untouched.
+func parseArgs(args []string, stderr io.Writer) (options, error) {
+	var opts options
+
+	flags := flag.NewFlagSet("jobwrapper", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.BoolVar(&opts.noWait, "no-wait", false, `skip the job if its group is locked, as with on_locked = "skip"`)
+	shared := flags.Bool("shared", false, "hold the group lock shared with other --shared jobs")
+	exclusive := flags.Bool("exclusive", false, "hold the group lock exclusively (default)")
+	flags.Func("priority", "queue for the lock ahead of waiting jobs with a lower `priority` (default from the configuration)", func(value string) error {
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid priority %q", value)
+		}
+		opts.priority = &priority
+		return nil
+	})
+	var groups groupList
+	flags.Var(&groups, "group", "lock `group` as well, instead of naming the groups before the script; may be repeated")
+	if err := flags.Parse(args); err != nil {
+		return opts, withExitCode(exitUsage, err)
+	}
+
+	switch {
+	case *shared && *exclusive:
+		return opts, withExitCode(exitUsage, fmt.Errorf("--shared and --exclusive cannot be used together"))
+	case *shared:
+		opts.mode = lock.ModeShared
+	default:
+		opts.mode = lock.ModeExclusive
+	}
+
+	positional := flags.Args()
+	if len(groups) == 0 && len(positional) > 0 {
+		_ = groups.Set(positional[0])
+		positional = positional[1:]
+	}
+	if len(groups) == 0 || len(positional) < 1 {
+		return opts, withExitCode(exitUsage, fmt.Errorf("%s", usage))
+	}
+	// Groups are always locked in the same order, so that two jobs locking
+	// overlapping groups cannot each hold one the other is waiting for
+	opts.groups = slices.Compact(slices.SortedFunc(slices.Values(groups), lock.CompareGroups))
+	for _, group := range opts.groups {
+		if err := lock.ValidateGroup(group); err != nil {
+			return opts, withExitCode(exitUsage, err)
+		}
+		if group == reservedGroup {
+			return opts, withExitCode(exitUsage, fmt.Errorf("%w %q: reserved for listing locks", lock.ErrInvalidGroup, group))
+		}
+	}
+	opts.cmd = positional[0]
+	opts.cmdArgs = positional[1:]
+	return opts, nil
+}
+
+// groupList is a flag that collects groups from repeated and comma-separated
+// values.
+type groupList []string
+
+func (g *groupList) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *groupList) Set(value string) error {
+	for _, group := range strings.Split(value, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			*g = append(*g, group)
+		}
+	}
+	return nil
+}
+
+// onLockedPolicy controls what happens when a job's group is already locked.
+type onLockedPolicy string
+
+const (
+	// onLockedWait waits up to the timeout for the lock.
+	onLockedWait onLockedPolicy = "wait"
+	// onLockedSkip skips the job without waiting.
+	onLockedSkip onLockedPolicy = "skip"
+	// onLockedFail fails without waiting.
+	onLockedFail onLockedPolicy = "fail"
+)
+
+// parseOnLocked validates an on_locked policy from the configuration file.
+func parseOnLocked(s string) (onLockedPolicy, error) {
+	switch policy := onLockedPolicy(s); policy {
+	case onLockedWait, onLockedSkip, onLockedFail:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown policy %q", s)
+}
@@ -0,0 +1,50 @@
+package jobwrapper
+
+import (
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/config"
+	"github.com/jacobalberty/jobwrapper/internal/command"
+)
+
+// shouldRetry reports whether a failed attempt may be retried. Only jobs
+// that ran and exited with a retryable exit code are retried; jobs that
+// were killed, lost their locks or could not be started are not.
+func shouldRetry(retry config.RetryConfig, err error) bool {
+	if errors.Is(err, ErrLockLost) {
+		return false
+	}
+	var jobErr *command.JobExitError
+	if !errors.As(err, &jobErr) || jobErr.Signal != nil || errors.Is(err, command.ErrMaxRuntimeExceeded) {
+		return false
+	}
+	if jobErr.ExitCode <= 0 {
+		return false
+	}
+	return len(retry.RetryableExitCodes) == 0 || slices.Contains(retry.RetryableExitCodes, jobErr.ExitCode)
+}
+
+// defaultMaxRetryBackoff caps the retry backoff when max_backoff is not set.
+const defaultMaxRetryBackoff = time.Hour
+
+// retryBackoff returns how long to wait after the given failed attempt. The
+// delay doubles with each attempt up to the maximum, and a random jitter of
+// up to half the delay is subtracted so concurrent retries spread out.
+func retryBackoff(retry config.RetryConfig, attempt int) time.Duration {
+	limit := time.Duration(retry.MaxBackoff)
+	if limit <= 0 {
+		limit = defaultMaxRetryBackoff
+	}
+	delay := time.Duration(retry.InitialBackoff)
+	for i := 1; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	delay = min(delay, limit)
+	if delay <= 0 {
+		return 0
+	}
+	return delay - rand.N(delay/2+1)
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package jobwrapper_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jacobalberty/jobwrapper"
+)
+
+func TestRun_EmbeddedErrors(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if err := os.Mkdir(filepath.Join(home, ".jobwrapper"), 0755); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	err := jobwrapper.Run(context.Background(), []string{"backup", "sh", "-c", "exit 3"}, &bytes.Buffer{}, &bytes.Buffer{})
+	var jobErr *jobwrapper.JobExitError
+	if !errors.As(err, &jobErr) || jobErr.ExitCode != 3 {
+		t.Fatalf("Expected the job's exit code, got %v", err)
+	}
+	if code := jobwrapper.ExitCode(err); code != 3 {
+		t.Errorf("Expected exit code 3, got %d", code)
+	}
+
+	if err := jobwrapper.Run(context.Background(), []string{"backup", "true"}, &bytes.Buffer{}, &bytes.Buffer{}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
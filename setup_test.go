@@ -1,15 +1,16 @@
-package main
+package jobwrapper
 
 import (
 	"bytes"
 	"context"
 	"io"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/jacobalberty/jobwrapper/filesystem"
 	"github.com/jacobalberty/jobwrapper/internal/command"
-	"github.com/jacobalberty/jobwrapper/internal/filesystem"
-	"github.com/jacobalberty/jobwrapper/internal/lock"
+	"github.com/jacobalberty/jobwrapper/lock"
 )
 
 // TestMocks is a struct that contains all the mocks used in the test
@@ -19,6 +20,27 @@ type TestMocks struct {
 	CommandContext func(ctx context.Context, name string, args ...string) command.Command
 }
 
+// configFileSystem returns a mock filesystem that serves conf as the
+// configuration file
+func configFileSystem(t *testing.T, conf string) *filesystem.MockFileSystem {
+	t.Helper()
+	return &filesystem.MockFileSystem{
+		OpenFunc: func(name string) (io.ReadCloser, error) {
+			if strings.HasSuffix(name, "jobwrapper.conf") {
+				return io.NopCloser(strings.NewReader(conf)), nil
+			}
+			return nil, os.ErrNotExist
+		},
+		MkdirAllFunc: func(path string, perm os.FileMode) error {
+			return nil
+		},
+		OpenFileFunc: func(name string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+			return &filesystem.ReadWriteCloserBuffer{Buffer: &bytes.Buffer{}}, nil
+		},
+		RemoveFunc: func(name string) error { return nil },
+	}
+}
+
 // testSetup prepares the necessary mocks or returns default implementations
 func testSetup(t *testing.T, mockFileSystem *filesystem.MockFileSystem, mockLocker *lock.MockLocker, mockCmdCtx func(ctx context.Context, name string, args ...string) command.Command) TestMocks {
 	t.Helper()
@@ -0,0 +1,106 @@
+package jobwrapper
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/jacobalberty/jobwrapper/internal/command"
+)
+
+// signalRelay catches the signals jobwrapper handles on behalf of its job.
+// A signal caught before the job starts cancels the run, while signals
+// caught once it has started are forwarded to it.
+type signalRelay struct {
+	caught  chan os.Signal
+	forward chan os.Signal
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mu       sync.Mutex
+	started  bool
+	received os.Signal
+}
+
+// newSignalRelay starts catching the named signals. The returned context is
+// canceled if one is caught before the job starts.
+func newSignalRelay(ctx context.Context, names []string) (*signalRelay, context.Context, error) {
+	signals := make([]os.Signal, 0, len(names))
+	for _, name := range names {
+		sig, err := command.ParseSignal(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		signals = append(signals, sig)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &signalRelay{
+		caught:  make(chan os.Signal, 1),
+		forward: make(chan os.Signal, 1),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	if len(signals) > 0 {
+		signal.Notify(r.caught, signals...)
+	}
+	go r.loop()
+
+	return r, ctx, nil
+}
+
+func (r *signalRelay) loop() {
+	for {
+		select {
+		case sig := <-r.caught:
+			r.mu.Lock()
+			r.received = sig
+			started := r.started
+			r.mu.Unlock()
+
+			if !started {
+				r.cancel()
+				continue
+			}
+			select {
+			case r.forward <- sig:
+			default:
+				// A signal is already waiting to be forwarded
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// jobStarted switches the relay to forwarding signals to the job. It returns
+// the channel the job should receive them on.
+func (r *signalRelay) jobStarted() <-chan os.Signal {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.started = true
+	return r.forward
+}
+
+// jobFinished switches the relay back to canceling the run when a signal is
+// caught, such as while waiting to retry the job.
+func (r *signalRelay) jobFinished() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.started = false
+}
+
+// lastSignal returns the last signal caught, or nil.
+func (r *signalRelay) lastSignal() os.Signal {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.received
+}
+
+// stop stops catching signals.
+func (r *signalRelay) stop() {
+	signal.Stop(r.caught)
+	close(r.done)
+	r.cancel()
+}
@@ -0,0 +1,143 @@
+package jobwrapper
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jacobalberty/jobwrapper/history"
+	"github.com/jacobalberty/jobwrapper/internal/command"
+	"github.com/jacobalberty/jobwrapper/lock"
+)
+
+// staleAction controls what a waiting job does about a job that has held its
+// group for longer than stale_after.
+type staleAction string
+
+const (
+	// staleActionLog only logs the stale holder.
+	staleActionLog staleAction = "log"
+	// staleActionTerm sends SIGTERM to the holder's process group.
+	staleActionTerm staleAction = "term"
+	// staleActionKill sends SIGKILL to the holder's process group.
+	staleActionKill staleAction = "kill"
+)
+
+// parseStaleAction validates a stale_action from the configuration file.
+func parseStaleAction(s string) (staleAction, error) {
+	switch action := staleAction(s); action {
+	case staleActionLog, staleActionTerm, staleActionKill:
+		return action, nil
+	}
+	return "", fmt.Errorf("unknown action %q", s)
+}
+
+// staleCheckInterval is how often the holders of the job's groups are checked
+// while none of them is about to become stale.
+const staleCheckInterval = 10 * time.Second
+
+// watchStale checks the holders of the job's groups until the returned
+// function is called, and deals with each holder that has held a group for
+// longer than its stale_after. The returned function waits for the checks to stop,
+// so that the history is not written concurrently afterwards.
+func (j *job) watchStale(ctx context.Context) (stop func()) {
+	if j.staleHolders == nil {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handled := make(map[string]bool)
+		for {
+			wait := j.checkStale(handled)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// checkStale deals with the stale holders of the job's groups that have not
+// been handled yet, and returns how long to wait before checking again.
+func (j *job) checkStale(handled map[string]bool) time.Duration {
+	next := staleCheckInterval
+	for _, group := range j.groups {
+		staleAfter := time.Duration(j.lockCfg.ForGroup(group).StaleAfter)
+		if staleAfter <= 0 {
+			continue
+		}
+		holders, err := j.staleHolders.Holders(group)
+		if err != nil {
+			fmt.Fprintf(j.stderr, "Error reading the holders of group '%s': %v\n", group, err)
+			continue
+		}
+		for _, holder := range holders {
+			// The job may already hold some of its groups
+			if holder.Acquired.IsZero() || holder.RunID == j.holder.RunID || handled[holder.RunID] {
+				continue
+			}
+			held := time.Since(holder.Acquired)
+			if held < staleAfter {
+				next = min(next, staleAfter-held)
+				continue
+			}
+			handled[holder.RunID] = true
+			j.reclaim(group, holder, held)
+		}
+	}
+	return next
+}
+
+// reclaim logs a stale holder, signals it if stale_action asks for it, and
+// records what was done in the history of both runs.
+func (j *job) reclaim(group string, holder lock.Holder, held time.Duration) {
+	action := j.stopStale(group, holder)
+	held = held.Round(time.Second)
+	fmt.Fprintf(j.stderr, "Stale lock holder: run %s (pid %d on %s) has held group '%s' for %s; %s\n",
+		holder.RunID, holder.PID, holder.Hostname, group, held, action)
+
+	j.result.StaleHolders = append(j.result.StaleHolders, fmt.Sprintf("run %s held group '%s' for %s; %s", holder.RunID, group, held, action))
+	if len(holder.Command) == 0 {
+		return
+	}
+	reason := fmt.Sprintf("held group '%s' for %s; found by run %s, which %s", group, held, j.holder.RunID, action)
+	if err := history.WriteStaleRun(j.fs, &j.cfg, holder.Command[0], holder.Command[1:], holder.RunID, holder.Started, reason); err != nil {
+		fmt.Fprintf(j.stderr, "Error writing history of run %s: %v\n", holder.RunID, err)
+	}
+}
+
+// stopStale signals the process group of a stale holder as the group's
+// stale_action asks, and describes what was done.
+func (j *job) stopStale(group string, holder lock.Holder) string {
+	// Validated before the job started
+	action, _ := parseStaleAction(j.lockCfg.ForGroup(group).StaleAction)
+	if action == staleActionLog {
+		return "logged it"
+	}
+	hostname, _ := os.Hostname()
+	switch {
+	case holder.Hostname != hostname:
+		return "did not signal it as it runs on another host"
+	case holder.PGID == 0:
+		return "did not signal it as its process group is unknown"
+	case holder.PGID == j.holder.PGID:
+		return "did not signal it as it shares this run's process group"
+	}
+
+	signal := "SIGTERM"
+	if action == staleActionKill {
+		signal = "SIGKILL"
+	}
+	if err := command.StopProcessGroup(holder.PGID, action == staleActionKill); err != nil {
+		return fmt.Sprintf("failed to send %s to process group %d: %v", signal, holder.PGID, err)
+	}
+	return fmt.Sprintf("sent %s to process group %d", signal, holder.PGID)
+}